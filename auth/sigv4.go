@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm       = "AWS4-HMAC-SHA256"
+	iso8601         = "20060102T150405Z"
+	scopeTerm       = "aws4_request"
+	maxSkew         = 15 * time.Minute
+	maxPresignAge   = 7 * 24 * time.Hour
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	streamingPrefix = "STREAMING-"
+)
+
+//Error is an authentication failure, carrying the S3 error code and status to return
+type Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func accessDenied(message string) *Error {
+	return &Error{Code: "AccessDenied", Message: message, Status: http.StatusForbidden}
+}
+
+func malformed(code string, message string) *Error {
+	return &Error{Code: code, Message: message, Status: http.StatusBadRequest}
+}
+
+//Streaming is true for a request whose body is sent in aws-chunked framing with a signature
+//per chunk.  That isn't decoded, the framing would be taken for the object's content
+func Streaming(h http.Header) bool {
+	if strings.HasPrefix(h.Get("X-Amz-Content-Sha256"), streamingPrefix) {
+		return true
+	}
+	for _, encoding := range strings.Split(h.Get("Content-Encoding"), ",") {
+		if strings.TrimSpace(encoding) == "aws-chunked" {
+			return true
+		}
+	}
+	return false
+}
+
+//ErrStreaming is returned for a Streaming request
+var ErrStreaming = &Error{Code: "NotImplemented", Status: http.StatusNotImplemented,
+	Message: "Chunked uploads signed with " + streamingPrefix + "* payloads are not supported, sign the whole payload or send it UNSIGNED-PAYLOAD."}
+
+//Verifier checks AWS Signature V4 signed requests against a set of access keys
+type Verifier struct {
+	keys map[string]string //access key id to secret access key
+	now  func() time.Time
+}
+
+//NewVerifier for the given access key id to secret key map
+func NewVerifier(keys map[string]string) *Verifier {
+	return &Verifier{keys: keys, now: time.Now}
+}
+
+//signature is the parsed signing information of a request, from either the
+//Authorization header or a presigned URL
+type signature struct {
+	accessKey     string
+	date          string //yyyymmdd of the credential scope
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	presigned     bool
+}
+
+//Verify checks the request signature and returns the access key id the request was signed with
+func (v *Verifier) Verify(r *http.Request) (string, error) {
+	var sig *signature
+	var err *Error
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		sig, err = v.parsePresigned(r)
+	} else if r.Header.Get("Authorization") != "" {
+		sig, err = v.parseHeader(r)
+	} else {
+		return "", accessDenied("Anonymous access is forbidden for this operation")
+	}
+	if err != nil {
+		return "", err
+	}
+	if Streaming(r.Header) {
+		return "", ErrStreaming
+	}
+
+	if sig.date != sig.amzDate.UTC().Format("20060102") || sig.service != "s3" {
+		return "", &Error{Code: "SignatureDoesNotMatch", Status: http.StatusForbidden,
+			Message: "The credential scope does not match the request date or service."}
+	}
+
+	secret, ok := v.keys[sig.accessKey]
+	if !ok {
+		return "", &Error{Code: "InvalidAccessKeyId", Status: http.StatusForbidden,
+			Message: "The AWS Access Key Id you provided does not exist in our records."}
+	}
+
+	payload := unsignedPayload
+	if !sig.presigned {
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+	}
+	canonical := canonicalRequest(r, sig, payload)
+	scope := strings.Join([]string{sig.date, sig.region, sig.service, scopeTerm}, "/")
+	hashed := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{algorithm, sig.amzDate.Format(iso8601), scope,
+		hex.EncodeToString(hashed[:])}, "\n")
+
+	key := signingKey(secret, sig.date, sig.region, sig.service)
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return "", &Error{Code: "SignatureDoesNotMatch", Status: http.StatusForbidden,
+			Message: "The request signature we calculated does not match the signature you provided."}
+	}
+	return sig.accessKey, nil
+}
+
+//parseHeader reads an Authorization header of the form
+//AWS4-HMAC-SHA256 Credential=AKID/20130524/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=...
+func (v *Verifier) parseHeader(r *http.Request) (*signature, *Error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, algorithm+" ") {
+		return nil, malformed("AuthorizationHeaderMalformed", "Only "+algorithm+" signatures are supported")
+	}
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(header, algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	sig, err := parseCredential(fields["Credential"], "AuthorizationHeaderMalformed")
+	if err != nil {
+		return nil, err
+	}
+	if fields["SignedHeaders"] == "" || fields["Signature"] == "" {
+		return nil, malformed("AuthorizationHeaderMalformed", "The authorization header is missing SignedHeaders or Signature")
+	}
+	sig.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	sig.signature = fields["Signature"]
+
+	dateHeader := "x-amz-date"
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate != "" {
+		sig.amzDate, _ = time.Parse(iso8601, amzDate)
+	} else if date := r.Header.Get("Date"); date != "" {
+		dateHeader = "date"
+		sig.amzDate, _ = http.ParseTime(date)
+	}
+	if sig.amzDate.IsZero() {
+		return nil, accessDenied("AWS authentication requires a valid Date or x-amz-date header")
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") == "" {
+		return nil, malformed("InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+	}
+	//without these a signature could be replayed against another host, at another time or with another body
+	if err := requireSigned(sig, "AuthorizationHeaderMalformed", "host", dateHeader, "x-amz-content-sha256"); err != nil {
+		return nil, err
+	}
+	skew := v.now().Sub(sig.amzDate)
+	if skew > maxSkew || skew < -maxSkew {
+		return nil, &Error{Code: "RequestTimeTooSkewed", Status: http.StatusForbidden,
+			Message: "The difference between the request time and the current time is too large."}
+	}
+	return sig, nil
+}
+
+//parsePresigned reads the X-Amz-* query parameters of a presigned URL
+func (v *Verifier) parsePresigned(r *http.Request) (*signature, *Error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != algorithm {
+		return nil, malformed("AuthorizationQueryParametersError", "X-Amz-Algorithm only supports "+algorithm)
+	}
+	sig, err := parseCredential(query.Get("X-Amz-Credential"), "AuthorizationQueryParametersError")
+	if err != nil {
+		return nil, err
+	}
+	sig.presigned = true
+	sig.signature = query.Get("X-Amz-Signature")
+	sig.signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	amzDate, errT := time.Parse(iso8601, query.Get("X-Amz-Date"))
+	if errT != nil || sig.signature == "" || query.Get("X-Amz-SignedHeaders") == "" {
+		return nil, malformed("AuthorizationQueryParametersError",
+			"Query-string authentication requires the X-Amz-Date, X-Amz-SignedHeaders and X-Amz-Signature parameters")
+	}
+	sig.amzDate = amzDate
+	if err := requireSigned(sig, "AuthorizationQueryParametersError", "host"); err != nil {
+		return nil, err
+	}
+
+	expires, errE := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if errE != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignAge {
+		return nil, malformed("AuthorizationQueryParametersError",
+			"X-Amz-Expires must be a number of seconds between 0 and 604800")
+	}
+	now := v.now()
+	if now.Before(amzDate.Add(-maxSkew)) {
+		return nil, accessDenied("Request is not valid yet")
+	}
+	if now.After(amzDate.Add(time.Duration(expires) * time.Second)) {
+		return nil, accessDenied("Request has expired")
+	}
+	return sig, nil
+}
+
+//parseCredential splits AKID/20130524/us-east-1/s3/aws4_request
+func parseCredential(credential string, code string) (*signature, *Error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != scopeTerm {
+		return nil, malformed(code, "The credential is mal-formed; expecting \"<YOUR-AKID>/YYYYMMDD/REGION/SERVICE/aws4_request\".")
+	}
+	return &signature{accessKey: parts[0], date: parts[1], region: parts[2], service: parts[3]}, nil
+}
+
+//requireSigned checks that the named headers are among the signed ones
+func requireSigned(sig *signature, code string, names ...string) *Error {
+	for _, name := range names {
+		found := false
+		for _, signed := range sig.signedHeaders {
+			if signed == name {
+				found = true
+			}
+		}
+		if !found {
+			return malformed(code, "The "+name+" header must be signed")
+		}
+	}
+	return nil
+}
+
+func canonicalRequest(r *http.Request, sig *signature, payload string) string {
+	headers := make([]string, 0, len(sig.signedHeaders))
+	for _, name := range sig.signedHeaders {
+		headers = append(headers, name+":"+headerValue(r, name))
+	}
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.Query()),
+		strings.Join(headers, "\n") + "\n",
+		strings.Join(sig.signedHeaders, ";"),
+		payload,
+	}, "\n")
+}
+
+//headerValue returns the trimmed value of a signed header.  Go moves Host and
+//Content-Length out of the header map, so those are read from the request
+func headerValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if r.Header.Get("Content-Length") == "" && r.ContentLength >= 0 {
+			return strconv.FormatInt(r.ContentLength, 10)
+		}
+	}
+	values := r.Header[http.CanonicalHeaderKey(name)]
+	trimmed := make([]string, 0, len(values))
+	for _, v := range values {
+		trimmed = append(trimmed, strings.Join(strings.Fields(v), " "))
+	}
+	return strings.Join(trimmed, ",")
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for k, values := range query {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+//uriEncode percent encodes everything except the RFC 3986 unreserved characters.  S3 keys
+//keep their slashes in the canonical URI
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func signingKey(secret string, date string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, scopeTerm)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"s3envoy/loadArgs"
+	"s3envoy/queues"
+	"strings"
+	"time"
+)
+
+//Backend is the upstream object store s3envoy caches in front of
+type Backend interface {
+	//Get returns the whole object.  The caller closes the Body
+	Get(bucket string, key string) (*Object, error)
+	//GetRange returns length bytes from offset, or to the end of the object if length < 0
+	GetRange(bucket string, key string, offset int64, length int64) (*Object, error)
+	//Head returns the object's size and metadata without a Body
+	Head(bucket string, key string) (*Object, error)
+	//Put stores size bytes from body and returns the stored object, without a Body.  Its Meta
+	//has only the ETag
+	Put(bucket string, key string, body io.ReadSeeker, size int64, meta *queues.Metadata) (*Object, error)
+	//Delete removes an object.  Deleting a missing object is not an error
+	Delete(bucket string, key string) error
+	//List returns up to max objects whose keys start with prefix, in key order, after marker
+	List(bucket string, prefix string, marker string, max int) (*Listing, error)
+}
+
+//Object is an object, or a range of one, returned by a Backend
+type Object struct {
+	Body      io.ReadCloser
+	Size      int64 //length of Body
+	TotalSize int64 //size of the whole object, differs from Size for a range
+	Meta      *queues.Metadata
+	//Encryption is the x-amz-server-side-encryption of the object, AES256 or aws:kms, "" if
+	//not encrypted.  CustomerKey is set for SSE-C
+	Encryption  string
+	CustomerKey bool
+}
+
+//ETagIsMD5 is false when the object is encrypted with SSE-KMS or SSE-C.  S3 ETags of those
+//are not an MD5 of the content, even for a single part upload
+func (o *Object) ETagIsMD5() bool {
+	return strings.HasPrefix(o.Encryption, "aws:kms") == false && o.CustomerKey == false
+}
+
+//ObjectInfo is one entry of a Listing
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+//Listing is a page of List results
+type Listing struct {
+	Objects     []ObjectInfo
+	IsTruncated bool
+}
+
+//Error is a backend failure with the S3 error code and status clients should see
+type Error struct {
+	Code      string
+	Message   string
+	Status    int
+	RequestID string //set by the S3 backend
+	Err       error  //underlying error, if any
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Message + ": " + e.Err.Error()
+	}
+	return e.Code + ": " + e.Message
+}
+
+func noSuchKey() *Error {
+	return &Error{Code: "NoSuchKey", Message: "The specified key does not exist.", Status: http.StatusNotFound}
+}
+
+func noSuchBucket() *Error {
+	return &Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist", Status: http.StatusNotFound}
+}
+
+func invalidRange() *Error {
+	return &Error{Code: "InvalidRange", Message: "The requested range is not satisfiable", Status: http.StatusRequestedRangeNotSatisfiable}
+}
+
+//New creates the backend selected in the config file
+func New(args *loadArgs.Args) (Backend, error) {
+	switch args.Backend {
+	case "", "s3":
+		return NewS3(args), nil
+	case "fs":
+		return NewFS(args.BackendPath)
+	case "memory":
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown Backend %q, expecting s3, fs or memory", args.Backend)
+}
+
+//rangeOf clips a requested range to an object of the given size
+func rangeOf(size int64, offset int64, length int64) (int64, int64, error) {
+	if offset < 0 || offset >= size {
+		return 0, 0, invalidRange()
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return offset, length, nil
+}
@@ -0,0 +1,268 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"s3envoy/queues"
+	"testing"
+)
+
+//backends returns each offline backend, fresh, and a func removing what they leave behind
+func backends(t *testing.T) (map[string]Backend, func()) {
+	root, err := ioutil.TempDir("", "s3envoy-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFS(root + "/objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Backend{"fs": fs, "memory": NewMemory()}, func() { os.RemoveAll(root) }
+}
+
+//expectError fails unless err is a backend Error with code and status
+func expectError(t *testing.T, what string, err error, code string, status int) {
+	e, ok := err.(*Error)
+	if ok == false || e.Code != code || e.Status != status {
+		t.Errorf("%s: expected %s %d, got %v", what, code, status, err)
+	}
+}
+
+func put(t *testing.T, b Backend, key string, data []byte) *Object {
+	obj, err := b.Put("bkt", key, bytes.NewReader(data), int64(len(data)), &queues.Metadata{ContentType: "text/plain",
+		UserMeta: map[string]string{"owner": "me"}})
+	if err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+	return obj
+}
+
+func TestGetPutHead(t *testing.T) {
+	all, cleanup := backends(t)
+	defer cleanup()
+	data := []byte("some object content")
+	sum := md5.Sum(data)
+	etag := "\"" + hex.EncodeToString(sum[:]) + "\""
+	for name, b := range all {
+		if obj := put(t, b, "dir/key", data); obj.Size != int64(len(data)) || obj.Meta.ETag != etag {
+			t.Errorf("%s: put returned size %d and ETag %s", name, obj.Size, obj.Meta.ETag)
+		}
+
+		obj, err := b.Get("bkt", "dir/key")
+		if err != nil {
+			t.Fatalf("%s: get: %v", name, err)
+		}
+		read, _ := ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		if bytes.Equal(read, data) == false || obj.Size != int64(len(data)) || obj.TotalSize != int64(len(data)) {
+			t.Errorf("%s: got %q, size %d of %d", name, read, obj.Size, obj.TotalSize)
+		}
+		if obj.Meta.ETag != etag || obj.Meta.ContentType != "text/plain" || obj.Meta.UserMeta["owner"] != "me" ||
+			obj.Meta.LastModified.IsZero() == true {
+			t.Errorf("%s: got metadata %+v", name, obj.Meta)
+		}
+
+		head, err := b.Head("bkt", "dir/key")
+		if err != nil {
+			t.Fatalf("%s: head: %v", name, err)
+		}
+		if head.Body != nil || head.Size != int64(len(data)) || head.Meta.ETag != etag || head.Meta.ContentType != "text/plain" {
+			t.Errorf("%s: head returned size %d, metadata %+v", name, head.Size, head.Meta)
+		}
+
+		//a put replaces the object
+		put(t, b, "dir/key", []byte("new"))
+		if obj, err = b.Get("bkt", "dir/key"); err == nil {
+			read, _ = ioutil.ReadAll(obj.Body)
+			obj.Body.Close()
+		}
+		if err != nil || string(read) != "new" {
+			t.Errorf("%s: got %q after overwriting, error %v", name, read, err)
+		}
+	}
+}
+
+func TestMissing(t *testing.T) {
+	all, cleanup := backends(t)
+	defer cleanup()
+	for name, b := range all {
+		put(t, b, "present", []byte("x"))
+		_, err := b.Get("bkt", "absent")
+		expectError(t, name+" get", err, "NoSuchKey", http.StatusNotFound)
+		_, err = b.GetRange("bkt", "absent", 0, 1)
+		expectError(t, name+" get range", err, "NoSuchKey", http.StatusNotFound)
+		_, err = b.Head("bkt", "absent")
+		expectError(t, name+" head", err, "NoSuchKey", http.StatusNotFound)
+		if err = b.Delete("bkt", "absent"); err != nil {
+			t.Errorf("%s: deleting a missing object: %v", name, err)
+		}
+	}
+	//only the fs backend has buckets of its own
+	_, err := all["fs"].Get("nobucket", "present")
+	expectError(t, "fs get from a missing bucket", err, "NoSuchBucket", http.StatusNotFound)
+	_, err = all["fs"].List("nobucket", "", "", -1)
+	expectError(t, "fs list of a missing bucket", err, "NoSuchBucket", http.StatusNotFound)
+}
+
+func TestGetRange(t *testing.T) {
+	all, cleanup := backends(t)
+	defer cleanup()
+	data := []byte("0123456789abcdefghij")
+	cases := []struct {
+		name   string
+		key    string
+		offset int64
+		length int64
+		want   string //"" with code set for an error
+		code   string
+	}{
+		{"start", "obj", 0, 5, "01234", ""},
+		{"middle", "obj", 10, 3, "abc", ""},
+		{"to the end", "obj", 15, -1, "fghij", ""},
+		{"clipped to the end", "obj", 18, 10, "ij", ""},
+		{"last byte", "obj", 19, 1, "j", ""},
+		{"past the end", "obj", 20, 1, "", "InvalidRange"},
+		{"far past the end", "obj", 1000, -1, "", "InvalidRange"},
+		{"negative offset", "obj", -1, 5, "", "InvalidRange"},
+		{"empty object", "empty", 0, -1, "", ""},
+		{"into an empty object", "empty", 1, -1, "", "InvalidRange"},
+	}
+	for name, b := range all {
+		put(t, b, "obj", data)
+		put(t, b, "empty", nil)
+		for _, c := range cases {
+			obj, err := b.GetRange("bkt", c.key, c.offset, c.length)
+			if c.code != "" {
+				expectError(t, name+" "+c.name, err, c.code, http.StatusRequestedRangeNotSatisfiable)
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s %s: %v", name, c.name, err)
+				continue
+			}
+			read, _ := ioutil.ReadAll(obj.Body)
+			obj.Body.Close()
+			if string(read) != c.want || obj.Size != int64(len(c.want)) {
+				t.Errorf("%s %s: got %q with size %d, expected %q", name, c.name, read, obj.Size, c.want)
+			}
+			if total := map[string]int64{"obj": 20, "empty": 0}[c.key]; obj.TotalSize != total {
+				t.Errorf("%s %s: total size %d, expected %d", name, c.name, obj.TotalSize, total)
+			}
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	all, cleanup := backends(t)
+	defer cleanup()
+	for name, b := range all {
+		put(t, b, "a", []byte("a"))
+		put(t, b, "b", []byte("b"))
+		if err := b.Delete("bkt", "a"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		_, err := b.Get("bkt", "a")
+		expectError(t, name+" get after delete", err, "NoSuchKey", http.StatusNotFound)
+		if _, err = b.Head("bkt", "b"); err != nil {
+			t.Errorf("%s: deleting a took b with it: %v", name, err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	all, cleanup := backends(t)
+	defer cleanup()
+	keys := []string{"logs/2", "data/b", "logs/1", "data/a/x", "top"}
+	cases := []struct {
+		name      string
+		prefix    string
+		marker    string
+		max       int
+		want      []string
+		truncated bool
+	}{
+		{"everything", "", "", -1, []string{"data/a/x", "data/b", "logs/1", "logs/2", "top"}, false},
+		{"prefix", "data/", "", -1, []string{"data/a/x", "data/b"}, false},
+		{"no match", "nothing/", "", -1, nil, false},
+		{"after a marker", "", "logs/1", -1, []string{"logs/2", "top"}, false},
+		{"truncated", "", "", 2, []string{"data/a/x", "data/b"}, true},
+		{"next page", "", "data/b", 2, []string{"logs/1", "logs/2"}, true},
+		{"last page", "", "logs/2", 2, []string{"top"}, false},
+		{"exactly max", "logs/", "", 2, []string{"logs/1", "logs/2"}, false},
+	}
+	for name, b := range all {
+		for _, key := range keys {
+			put(t, b, key, []byte(key))
+		}
+		for _, c := range cases {
+			listing, err := b.List("bkt", c.prefix, c.marker, c.max)
+			if err != nil {
+				t.Errorf("%s %s: %v", name, c.name, err)
+				continue
+			}
+			var got []string
+			for _, o := range listing.Objects {
+				got = append(got, o.Key)
+				if o.Size != int64(len(o.Key)) || o.ETag == "" || o.LastModified.IsZero() == true {
+					t.Errorf("%s %s: listed %+v", name, c.name, o)
+				}
+			}
+			if len(got) != len(c.want) || listing.IsTruncated != c.truncated {
+				t.Errorf("%s %s: listed %v, truncated %v, expected %v, %v", name, c.name, got, listing.IsTruncated,
+					c.want, c.truncated)
+				continue
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("%s %s: listed %v, expected %v", name, c.name, got, c.want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestFSKeysStayInTheirBucket(t *testing.T) {
+	root, err := ioutil.TempDir("", "s3envoy-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	b, err := NewFS(root + "/objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, b, "inside", []byte("x"))
+	ioutil.WriteFile(root+"/secret", []byte("secret"), 0644)
+
+	for _, key := range []string{"../secret", "../../secret", "a/../../secret", "../.meta/bkt/inside.json",
+		"../other/key", ".."} {
+		_, err = b.Get("bkt", key)
+		expectError(t, "get "+key, err, "InvalidArgument", http.StatusBadRequest)
+		_, err = b.Head("bkt", key)
+		expectError(t, "head "+key, err, "InvalidArgument", http.StatusBadRequest)
+		_, err = b.Put("bkt", key, bytes.NewReader([]byte("overwritten")), 11, &queues.Metadata{})
+		expectError(t, "put "+key, err, "InvalidArgument", http.StatusBadRequest)
+		err = b.Delete("bkt", key)
+		expectError(t, "delete "+key, err, "InvalidArgument", http.StatusBadRequest)
+	}
+	//nor can the metadata directory be used as a bucket
+	_, err = b.Put(fsMetaDir, "key", bytes.NewReader([]byte("x")), 1, &queues.Metadata{})
+	expectError(t, "put into the metadata directory", err, "InvalidArgument", http.StatusBadRequest)
+
+	if data, _ := ioutil.ReadFile(root + "/secret"); string(data) != "secret" {
+		t.Fatal("a key outside the bucket was overwritten")
+	}
+	if _, err = os.Stat(filepath.Join(root, "other")); err == nil {
+		t.Fatal("a key created a directory outside the backend")
+	}
+	//a key that only passes through .. inside the bucket is fine
+	if _, err = b.Head("bkt", "a/../inside"); err != nil {
+		t.Fatalf("a/../inside: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package backend
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"s3envoy/queues"
+	"sort"
+	"strings"
+	"time"
+)
+
+//fsMetaDir holds the metadata of each object, mirroring the layout of the local cache
+const fsMetaDir = ".meta"
+
+//FS is a backend storing objects as files under a local directory, laid out as
+//root/bucket/key.  Buckets are the directories directly under root
+type FS struct {
+	root string
+}
+
+//NewFS backend rooted at the given directory
+func NewFS(root string) (*FS, error) {
+	if root == "" {
+		return nil, &Error{Code: "InternalError", Message: "the fs Backend needs a BackendPath", Status: http.StatusInternalServerError}
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &FS{root: root}, nil
+}
+
+//path of an object, refusing keys that would escape the bucket directory
+func (b *FS) path(dir string, bucket string, key string) (string, error) {
+	bucketDir := filepath.Join(b.root, dir, bucket)
+	p := filepath.Join(bucketDir, key)
+	if bucket == "" || bucket == fsMetaDir || !strings.HasPrefix(p, bucketDir+string(filepath.Separator)) {
+		return "", &Error{Code: "InvalidArgument", Message: "Invalid object key", Status: http.StatusBadRequest}
+	}
+	return p, nil
+}
+
+func (b *FS) checkBucket(bucket string) error {
+	if info, err := os.Stat(filepath.Join(b.root, bucket)); err != nil || !info.IsDir() {
+		return noSuchBucket()
+	}
+	return nil
+}
+
+func (b *FS) open(bucket string, key string) (*os.File, os.FileInfo, error) {
+	if err := b.checkBucket(bucket); err != nil {
+		return nil, nil, err
+	}
+	p, err := b.path("", bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil, noSuchKey()
+	} else if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return nil, nil, noSuchKey()
+	}
+	return file, info, nil
+}
+
+func (b *FS) meta(bucket string, key string, info os.FileInfo) *queues.Metadata {
+	meta := &queues.Metadata{LastModified: info.ModTime().UTC()}
+	if p, err := b.path(fsMetaDir, bucket, key+".json"); err == nil {
+		if data, errR := ioutil.ReadFile(p); errR == nil {
+			json.Unmarshal(data, meta)
+		}
+	}
+	return meta
+}
+
+//Get an object from the directory
+func (b *FS) Get(bucket string, key string) (*Object, error) {
+	return b.GetRange(bucket, key, 0, -1)
+}
+
+//GetRange gets part of an object from the directory
+func (b *FS) GetRange(bucket string, key string, offset int64, length int64) (*Object, error) {
+	file, info, err := b.open(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 && offset == 0 {
+		return &Object{Body: file, TotalSize: 0, Meta: b.meta(bucket, key, info)}, nil
+	}
+	offset, length, err = rangeOf(size, offset, length)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	body := struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}
+	return &Object{Body: body, Size: length, TotalSize: size, Meta: b.meta(bucket, key, info)}, nil
+}
+
+//Head returns an object's size and metadata
+func (b *FS) Head(bucket string, key string) (*Object, error) {
+	file, info, err := b.open(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return &Object{Size: info.Size(), TotalSize: info.Size(), Meta: b.meta(bucket, key, info)}, nil
+}
+
+//Put writes the object to a temp file that is renamed into place once complete
+func (b *FS) Put(bucket string, key string, body io.ReadSeeker, size int64, meta *queues.Metadata) (*Object, error) {
+	p, err := b.path("", bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".put-")
+	if err != nil {
+		return nil, err
+	}
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, size))
+	if errC := tmp.Close(); err == nil {
+		err = errC
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	stored := *meta
+	stored.ETag = "\"" + hex.EncodeToString(hash.Sum(nil)) + "\""
+	stored.LastModified = time.Now().UTC()
+	metaPath, _ := b.path(fsMetaDir, bucket, key+".json")
+	if err = os.MkdirAll(filepath.Dir(metaPath), 0755); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(metaPath, data, 0644); err != nil {
+		return nil, err
+	}
+	return &Object{Size: size, TotalSize: size, Meta: &queues.Metadata{ETag: stored.ETag}}, nil
+}
+
+//Delete an object and its metadata
+func (b *FS) Delete(bucket string, key string) error {
+	if err := b.checkBucket(bucket); err != nil {
+		return err
+	}
+	p, err := b.path("", bucket, key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if metaPath, errP := b.path(fsMetaDir, bucket, key+".json"); errP == nil {
+		os.Remove(metaPath)
+	}
+	return nil
+}
+
+//List walks the bucket directory for keys under prefix
+func (b *FS) List(bucket string, prefix string, marker string, max int) (*Listing, error) {
+	if err := b.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	bucketDir := filepath.Join(b.root, bucket)
+	var objects []ObjectInfo
+	err := filepath.Walk(bucketDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".put-") {
+			return err
+		}
+		key := filepath.ToSlash(strings.TrimPrefix(p, bucketDir+string(filepath.Separator)))
+		if strings.HasPrefix(key, prefix) && key > marker {
+			meta := b.meta(bucket, key, info)
+			objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ETag: meta.ETag, LastModified: meta.LastModified})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	listing := &Listing{Objects: objects}
+	if max >= 0 && len(objects) > max {
+		listing.Objects = objects[:max]
+		listing.IsTruncated = true
+	}
+	return listing, nil
+}
@@ -0,0 +1,127 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"s3envoy/queues"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memObject struct {
+	data []byte
+	meta queues.Metadata
+}
+
+//Memory is a backend keeping objects in a map.  Nothing survives a restart, it is meant
+//for running the proxy offline in tests and development.  Any bucket name is accepted
+type Memory struct {
+	mutex   *sync.RWMutex
+	objects map[string]*memObject //bucket/key to object
+}
+
+//NewMemory backend with no objects
+func NewMemory() *Memory {
+	return &Memory{mutex: &sync.RWMutex{}, objects: make(map[string]*memObject)}
+}
+
+func (b *Memory) lookup(bucket string, key string) (*memObject, error) {
+	b.mutex.RLock()
+	obj, ok := b.objects[bucket+"/"+key]
+	b.mutex.RUnlock()
+	if !ok {
+		return nil, noSuchKey()
+	}
+	return obj, nil
+}
+
+//Get an object from memory
+func (b *Memory) Get(bucket string, key string) (*Object, error) {
+	return b.GetRange(bucket, key, 0, -1)
+}
+
+//GetRange gets part of an object from memory
+func (b *Memory) GetRange(bucket string, key string, offset int64, length int64) (*Object, error) {
+	obj, err := b.lookup(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(obj.data))
+	meta := obj.meta
+	if size == 0 && offset == 0 {
+		return &Object{Body: ioutil.NopCloser(bytes.NewReader(nil)), Meta: &meta}, nil
+	}
+	offset, length, err = rangeOf(size, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	//stored data is never modified, Put replaces the whole object
+	body := ioutil.NopCloser(bytes.NewReader(obj.data[offset : offset+length]))
+	return &Object{Body: body, Size: length, TotalSize: size, Meta: &meta}, nil
+}
+
+//Head returns an object's size and metadata
+func (b *Memory) Head(bucket string, key string) (*Object, error) {
+	obj, err := b.lookup(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	meta := obj.meta
+	size := int64(len(obj.data))
+	return &Object{Size: size, TotalSize: size, Meta: &meta}, nil
+}
+
+//Put stores a copy of the object
+func (b *Memory) Put(bucket string, key string, body io.ReadSeeker, size int64, meta *queues.Metadata) (*Object, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, size))
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(data)
+	obj := &memObject{data: data, meta: *meta}
+	obj.meta.ETag = "\"" + hex.EncodeToString(sum[:]) + "\""
+	obj.meta.LastModified = time.Now().UTC()
+
+	b.mutex.Lock()
+	b.objects[bucket+"/"+key] = obj
+	b.mutex.Unlock()
+	return &Object{Size: size, TotalSize: size, Meta: &queues.Metadata{ETag: obj.meta.ETag}}, nil
+}
+
+//Delete an object from memory
+func (b *Memory) Delete(bucket string, key string) error {
+	b.mutex.Lock()
+	delete(b.objects, bucket+"/"+key)
+	b.mutex.Unlock()
+	return nil
+}
+
+//List the keys of a bucket under prefix
+func (b *Memory) List(bucket string, prefix string, marker string, max int) (*Listing, error) {
+	b.mutex.RLock()
+	var objects []ObjectInfo
+	for name, obj := range b.objects {
+		if !strings.HasPrefix(name, bucket+"/") {
+			continue
+		}
+		key := strings.TrimPrefix(name, bucket+"/")
+		if strings.HasPrefix(key, prefix) && key > marker {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(obj.data)),
+				ETag: obj.meta.ETag, LastModified: obj.meta.LastModified})
+		}
+	}
+	b.mutex.RUnlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	listing := &Listing{Objects: objects}
+	if max >= 0 && len(objects) > max {
+		listing.Objects = objects[:max]
+		listing.IsTruncated = true
+	}
+	return listing, nil
+}
@@ -0,0 +1,310 @@
+package backend
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"s3envoy/loadArgs"
+	"s3envoy/queues"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//discoveryRegion is used for the GetBucketLocation call when a bucket's region is "auto"
+const discoveryRegion = "us-east-1"
+
+//S3 is the AWS S3 backend.  Clients are built from each bucket's upstream config on
+//first use and shared by every request for the bucket
+type S3 struct {
+	args    *loadArgs.Args
+	mutex   *sync.Mutex
+	clients map[string]*s3.S3
+}
+
+//NewS3 backend
+func NewS3(args *loadArgs.Args) *S3 {
+	return &S3{args: args, mutex: &sync.Mutex{}, clients: make(map[string]*s3.S3)}
+}
+
+//client returns the shared S3 client for a bucket
+func (b *S3) client(bucket string) (*s3.S3, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if svc, ok := b.clients[bucket]; ok {
+		return svc, nil
+	}
+
+	up := b.args.UpstreamFor(bucket)
+	region := up.Region
+	if region == "auto" {
+		var err error
+		region, err = bucketRegion(up, bucket)
+		if err != nil {
+			return nil, toError(err, "Could not discover bucket region")
+		}
+		log.Infoln("Discovered region", region, "for bucket", bucket)
+	}
+	sess, err := newSession(up, region)
+	if err != nil {
+		return nil, &Error{Code: "InternalError", Message: "Could not create S3 session", Status: http.StatusInternalServerError, Err: err}
+	}
+	svc := s3.New(sess)
+	b.clients[bucket] = svc
+	return svc, nil
+}
+
+//bucketRegion asks S3 which region a bucket lives in
+func bucketRegion(up loadArgs.Upstream, bucket string) (string, error) {
+	sess, err := newSession(up, discoveryRegion)
+	if err != nil {
+		return "", err
+	}
+	out, err := s3.New(sess).GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return "", err
+	}
+	return s3.NormalizeBucketLocation(aws.StringValue(out.LocationConstraint)), nil
+}
+
+func newSession(up loadArgs.Upstream, region string) (*session.Session, error) {
+	cfg := aws.NewConfig().WithRegion(region).WithS3ForcePathStyle(up.PathStyle)
+	if up.Endpoint != "" {
+		cfg = cfg.WithEndpoint(up.Endpoint)
+	}
+
+	creds := up.Credentials
+	switch creds.Source {
+	case "", "default":
+	case "static":
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken))
+	case "env":
+		cfg = cfg.WithCredentials(credentials.NewEnvCredentials())
+	case "profile":
+		cfg = cfg.WithCredentials(credentials.NewSharedCredentials("", creds.Profile))
+	case "assume-role":
+		//the role is assumed with the default credential chain
+		base, err := session.NewSession(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfg = cfg.WithCredentials(stscreds.NewCredentials(base, creds.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if creds.ExternalID != "" {
+				p.ExternalID = aws.String(creds.ExternalID)
+			}
+		}))
+	default:
+		return nil, fmt.Errorf("unknown credentials Source %q", creds.Source)
+	}
+	return session.NewSession(cfg)
+}
+
+//toError translates an error returned by the AWS SDK, keeping the upstream S3 code,
+//message, status and request id where available
+func toError(err error, message string) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	e := &Error{Code: "InternalError", Message: message, Status: http.StatusInternalServerError, Err: err}
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return e
+	}
+	if aerr.Code() != "" {
+		e.Code = aerr.Code()
+	}
+	if aerr.Message() != "" {
+		e.Message = aerr.Message()
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		if reqErr.StatusCode() > 0 {
+			e.Status = reqErr.StatusCode()
+		}
+		e.RequestID = reqErr.RequestID()
+	}
+
+	//HEAD and some GET failures come back without a body, so only the status is known
+	switch e.Code {
+	case "NotFound":
+		e.Code = "NoSuchKey"
+	case "Forbidden":
+		e.Code = "AccessDenied"
+	}
+	return e
+}
+
+//metaFromS3 converts the object headers S3 returned into cache metadata
+func metaFromS3(contentType, contentEncoding, contentDisposition, contentLanguage, cacheControl, expires, etag *string,
+	lastModified *time.Time, userMeta map[string]*string) *queues.Metadata {
+	meta := &queues.Metadata{
+		ContentType:        aws.StringValue(contentType),
+		ContentEncoding:    aws.StringValue(contentEncoding),
+		ContentDisposition: aws.StringValue(contentDisposition),
+		ContentLanguage:    aws.StringValue(contentLanguage),
+		CacheControl:       aws.StringValue(cacheControl),
+		Expires:            aws.StringValue(expires),
+		ETag:               aws.StringValue(etag),
+		LastModified:       aws.TimeValue(lastModified),
+		UserMeta:           make(map[string]string),
+	}
+	if meta.LastModified.IsZero() {
+		meta.LastModified = time.Now().UTC()
+	}
+	for k, v := range userMeta {
+		meta.UserMeta[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return meta
+}
+
+func (b *S3) get(bucket string, key string, byteRange string) (*Object, error) {
+	svc, err := b.client(bucket)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	if byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+	out, err := svc.GetObject(input)
+	if err != nil {
+		return nil, toError(err, "Could not Dowload from S3")
+	}
+	obj := &Object{Body: out.Body, Size: aws.Int64Value(out.ContentLength)}
+	obj.TotalSize = obj.Size
+	//Content-Range: bytes 0-9/443
+	if cr := aws.StringValue(out.ContentRange); cr != "" {
+		if idx := strings.LastIndex(cr, "/"); idx >= 0 {
+			obj.TotalSize, _ = strconv.ParseInt(cr[idx+1:], 10, 64)
+		}
+	}
+	obj.Meta = metaFromS3(out.ContentType, out.ContentEncoding, out.ContentDisposition, out.ContentLanguage,
+		out.CacheControl, out.Expires, out.ETag, out.LastModified, out.Metadata)
+	obj.Encryption = aws.StringValue(out.ServerSideEncryption)
+	obj.CustomerKey = out.SSECustomerAlgorithm != nil
+	return obj, nil
+}
+
+//Get an object from S3
+func (b *S3) Get(bucket string, key string) (*Object, error) {
+	return b.get(bucket, key, "")
+}
+
+//GetRange gets part of an object from S3
+func (b *S3) GetRange(bucket string, key string, offset int64, length int64) (*Object, error) {
+	byteRange := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	if length >= 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	return b.get(bucket, key, byteRange)
+}
+
+//Head fetches only the object headers from S3
+func (b *S3) Head(bucket string, key string) (*Object, error) {
+	svc, err := b.client(bucket)
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, toError(err, "Could not Head object in S3")
+	}
+	size := aws.Int64Value(out.ContentLength)
+	meta := metaFromS3(out.ContentType, out.ContentEncoding, out.ContentDisposition, out.ContentLanguage,
+		out.CacheControl, out.Expires, out.ETag, out.LastModified, out.Metadata)
+	return &Object{Size: size, TotalSize: size, Meta: meta, Encryption: aws.StringValue(out.ServerSideEncryption),
+		CustomerKey: out.SSECustomerAlgorithm != nil}, nil
+}
+
+//Put uploads an object with its metadata.  When the metadata carries an MD5 ETag it is sent
+//as Content-MD5, so S3 rejects content that no longer matches what the client sent
+func (b *S3) Put(bucket string, key string, body io.ReadSeeker, size int64, meta *queues.Metadata) (*Object, error) {
+	svc, err := b.client(bucket)
+	if err != nil {
+		return nil, err
+	}
+	params := &s3.PutObjectInput{
+		Bucket:        aws.String(bucket), // required
+		Key:           aws.String(key),    // required
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		Metadata:      aws.StringMap(meta.UserMeta),
+	}
+	if sum, errH := hex.DecodeString(strings.Trim(meta.ETag, "\"")); errH == nil && len(sum) == md5.Size {
+		params.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum))
+	}
+	if meta.ContentType != "" {
+		params.ContentType = aws.String(meta.ContentType)
+	}
+	if meta.ContentEncoding != "" {
+		params.ContentEncoding = aws.String(meta.ContentEncoding)
+	}
+	if meta.ContentDisposition != "" {
+		params.ContentDisposition = aws.String(meta.ContentDisposition)
+	}
+	if meta.ContentLanguage != "" {
+		params.ContentLanguage = aws.String(meta.ContentLanguage)
+	}
+	if meta.CacheControl != "" {
+		params.CacheControl = aws.String(meta.CacheControl)
+	}
+	if expires, errE := http.ParseTime(meta.Expires); errE == nil {
+		params.Expires = aws.Time(expires)
+	}
+	out, err := svc.PutObject(params)
+	if err != nil {
+		return nil, toError(err, "Could not Upload to S3")
+	}
+	return &Object{Size: size, TotalSize: size, Meta: &queues.Metadata{ETag: aws.StringValue(out.ETag)},
+		Encryption: aws.StringValue(out.ServerSideEncryption), CustomerKey: out.SSECustomerAlgorithm != nil}, nil
+}
+
+//Delete an object from S3
+func (b *S3) Delete(bucket string, key string) error {
+	svc, err := b.client(bucket)
+	if err != nil {
+		return err
+	}
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return toError(err, "Could not Delete from S3")
+	}
+	return nil
+}
+
+//List objects in an S3 bucket
+func (b *S3) List(bucket string, prefix string, marker string, max int) (*Listing, error) {
+	svc, err := b.client(bucket)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.ListObjectsInput{Bucket: aws.String(bucket), MaxKeys: aws.Int64(int64(max))}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	if marker != "" {
+		input.Marker = aws.String(marker)
+	}
+	out, err := svc.ListObjects(input)
+	if err != nil {
+		return nil, toError(err, "Could not List S3 bucket")
+	}
+	listing := &Listing{IsTruncated: aws.BoolValue(out.IsTruncated)}
+	for _, obj := range out.Contents {
+		listing.Objects = append(listing.Objects, ObjectInfo{Key: aws.StringValue(obj.Key),
+			Size: aws.Int64Value(obj.Size), ETag: aws.StringValue(obj.ETag),
+			LastModified: aws.TimeValue(obj.LastModified)})
+	}
+	return listing, nil
+}
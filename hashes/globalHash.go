@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"s3envoy/loadArgs"
+	"s3envoy/metrics"
 	"sync"
 
 	log "github.com/Sirupsen/logrus"
@@ -31,6 +32,7 @@ func (h *Gh) AddToGH(fkey string, bucket string, peer string, send bool) {
 	log.Debugln("Add to global hash", bucket, fkey, send)
 	h.Mutex.Lock()
 	h.Hash[bucket+"/"+fkey] = peer //update the peer to contain the bucket+fkey value
+	metrics.GlobalHashSize.Set(float64(len(h.Hash)))
 	h.Mutex.Unlock()
 	if send == true {
 		h.sendUpdates(fkey, bucket, "true")
@@ -41,12 +43,51 @@ func (h *Gh) AddToGH(fkey string, bucket string, peer string, send bool) {
 func (h *Gh) RemoveFromGH(fkey string, bucket string, send bool) {
 	h.Mutex.Lock()
 	delete(h.Hash, bucket+"/"+fkey)
+	metrics.GlobalHashSize.Set(float64(len(h.Hash)))
 	h.Mutex.Unlock()
 	if send == true {
 		go h.sendUpdates(fkey, bucket, "false")
 	}
 }
 
+//RemovePeer drops every entry held by peer from the GH
+func (h *Gh) RemovePeer(peer string) {
+	h.Mutex.Lock()
+	for key, holder := range h.Hash {
+		if holder == peer {
+			delete(h.Hash, key)
+		}
+	}
+	metrics.GlobalHashSize.Set(float64(len(h.Hash)))
+	h.Mutex.Unlock()
+}
+
+//Leave tells every peer to drop all entries held by this node.  It returns once the
+//updates have been sent
+func (h *Gh) Leave() {
+	h.sendUpdates("", "", "leave")
+}
+
+//PurgeGH asks every peer to purge fkey, or all keys starting with it if prefix is set, from their cache
+func (h *Gh) PurgeGH(fkey string, bucket string, prefix bool) {
+	if prefix == true {
+		h.sendUpdates(fkey, bucket, "purge-prefix")
+	} else {
+		h.sendUpdates(fkey, bucket, "purge")
+	}
+}
+
+//Dump returns a copy of the GH table, bucket+fkey mapped to peer
+func (h *Gh) Dump() map[string]string {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	dump := make(map[string]string, len(h.Hash))
+	for key, peer := range h.Hash {
+		dump[key] = peer
+	}
+	return dump
+}
+
 //CheckGH to check if fkey is in any peer's store
 func (h *Gh) CheckGH(fkey string, bucket string) string {
 	h.Mutex.RLock()
@@ -62,13 +103,15 @@ func (h *Gh) CheckGH(fkey string, bucket string) string {
 //SendUpdates will update all peers on a new entry to the local cache.  update reflects whether
 //something should be in the hash table (true) or not (false)
 func (h *Gh) sendUpdates(fkey string, bucket string, update string) {
-	for _, peer := range h.args.Peers {
+	for _, peer := range h.args.PeerList() {
 		if h.args.CheckMemberAlive(peer) == true {
 			log.Debugln("Send update to peer:", peer)
 			upd := &HashUpdate{Peer: h.args.LocalName, BucketName: bucket, Fkey: fkey, Update: update}
 			data, errM := json.Marshal(upd)
 			if errM != nil {
 				log.Errorln(errM)
+				metrics.PeerUpdateFailures.Inc()
+				continue
 			}
 			buff := bytes.NewBuffer(data)
 			log.Debugln(peer)
@@ -78,7 +121,11 @@ func (h *Gh) sendUpdates(fkey string, bucket string, update string) {
 			resp, err := client.Do(req)
 			if err != nil {
 				log.Errorln(err)
+				metrics.PeerUpdateFailures.Inc()
 			} else {
+				if resp.StatusCode != http.StatusOK {
+					metrics.PeerUpdateFailures.Inc()
+				}
 				resp.Body.Close()
 			}
 		}
@@ -2,6 +2,7 @@ package hashes
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,19 +14,37 @@ type HashUpdate struct {
 	Peer       string
 	BucketName string
 	Fkey       string
-	Update     string //true = add and false = remove
+	Update     string //true = add, false = remove, leave = remove everything held by Peer, purge = drop Fkey from the cache and purge-prefix = drop every key starting with Fkey
 }
 
+//OnPurge is called when a peer asks for a key, or every key with a prefix, to be purged from the local cache
+var OnPurge func(bucket string, key string, prefix bool)
+
 func globalHashMan(w http.ResponseWriter, r *http.Request) {
+	//updates, purges most of all, are only taken from live cluster members
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || Ghash.args.Members == nil || Ghash.args.CheckMemberAlive(host) == false {
+		log.Warnln("Rejected global hash update from a non member", r.RemoteAddr)
+		http.Error(w, "not a cluster member", http.StatusForbidden)
+		return
+	}
 	update := new(HashUpdate)
-	err := json.NewDecoder(r.Body).Decode(update)
+	err = json.NewDecoder(r.Body).Decode(update)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorln("Could not decode global hash update", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	log.Debugln("Update: ", update.Peer, update.BucketName, update.Fkey, update.Update)
 
 	if update.Update == "true" {
 		Ghash.AddToGH(update.Fkey, update.BucketName, update.Peer, false)
+	} else if update.Update == "leave" {
+		Ghash.RemovePeer(update.Peer)
+	} else if update.Update == "purge" || update.Update == "purge-prefix" {
+		if OnPurge != nil {
+			OnPurge(update.BucketName, update.Fkey, update.Update == "purge-prefix")
+		}
 	} else {
 		Ghash.RemoveFromGH(update.Fkey, update.BucketName, false)
 	}
@@ -0,0 +1,95 @@
+package loadArgs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+//toJSON converts a config file to JSON, picking the format by extension: .yaml or .yml for
+//YAML, .toml for TOML and JSON for anything else.  Settings are then read the same way
+//whatever the format
+func toJSON(conf string, data []byte) ([]byte, error) {
+	var doc interface{}
+	switch strings.ToLower(filepath.Ext(conf)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		var table map[string]interface{}
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			return nil, err
+		}
+		doc = table
+	default:
+		return data, nil
+	}
+	doc, err := stringKeys(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+//stringKeys turns the map[interface{}]interface{} YAML decodes into the string keyed maps JSON needs
+func stringKeys(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for key, value := range t {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("setting names must be strings, got %v", key)
+			}
+			conv, err := stringKeys(value)
+			if err != nil {
+				return nil, err
+			}
+			m[name] = conv
+		}
+		return m, nil
+	case map[string]interface{}:
+		for key, value := range t {
+			conv, err := stringKeys(value)
+			if err != nil {
+				return nil, err
+			}
+			t[key] = conv
+		}
+		return t, nil
+	case []interface{}:
+		for i, value := range t {
+			conv, err := stringKeys(value)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = conv
+		}
+		return t, nil
+	case []map[string]interface{}:
+		//TOML arrays of tables
+		list := make([]interface{}, len(t))
+		for i, value := range t {
+			conv, err := stringKeys(value)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = conv
+		}
+		return list, nil
+	}
+	return v, nil
+}
+
+//decodeStrict unmarshals a setting, rejecting fields the target doesn't have
+func decodeStrict(data []byte, target interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(target)
+}
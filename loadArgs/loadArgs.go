@@ -1,42 +1,213 @@
 package loadArgs
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
-	"strconv"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Nitro/memberlist"
 	log "github.com/Sirupsen/logrus"
-	"github.com/pivotal-golang/bytefmt"
 )
 
 //Args struct to read config file and set global vars
 type Args struct {
-	LocalPath      string
-	TotalFiles     int
-	MemCap         int64
-	DiskCap        int64
-	MaxMemFileSize int64
-	Peers          []string
-	LocalName      string
-	Cluster        bool
-	ClientPort     string
-	HashPort       string
-	Members        *memberlist.Memberlist
+	LocalPath             string
+	TotalFiles            int
+	MemCap                int64
+	DiskCap               int64
+	CacheDirs             []CacheDir        //where cached objects are kept, empty for LocalPath with DiskCap
+	Placement             string            //how objects are spread over CacheDirs: hash or free
+	DirCheckInterval      time.Duration     //how often CacheDirs are probed, 0 to disable
+	DiskHighWatermark     int               //percent of a cache dir's filesystem used that starts background eviction
+	DiskLowWatermark      int               //percent used background eviction stops at
+	DiskCriticalWatermark int               //percent used at which a cache dir takes no new objects
+	WatermarkInterval     time.Duration     //how often filesystem usage is checked, 0 to disable
+	Fsync                 string            //when cache files are synced to disk: always, put or never
+	Dedup                 bool              //store identical content once, by SHA-256
+	Compress              map[string]string //content type, or type/* for any subtype, to gzip or zstd
+	EncryptionKeys        [][]byte          //AES-256 master keys, the first wraps new data keys.  Empty for no encryption
+	MaxMemFileSize        int64
+	Retention             []RetentionRule //how objects are kept by bucket and prefix, see RetentionRule
+	PromoteAfter          int             //disk hits before a small enough object is promoted into memory, 0 never
+	Peers                 []string
+	LocalName             string
+	Cluster               bool
+	ClientPort            string
+	HashPort              string
+	AdminPort             string        //listener for the admin API, empty to disable
+	AdminAddress          string        //interface the admin API listens on
+	AdminToken            string        //bearer token admin API requests must carry, empty for none
+	ScrubInterval         time.Duration //how often cached content is rehashed, 0 to disable
+	ShutdownTimeout       time.Duration //how long to wait for requests and uploads to finish on SIGTERM
+	ConfigWatch           time.Duration //how often to check the config file for changes, 0 to reload on SIGHUP only
+	LogLevel              string
+	AccessKeys            map[string]string   //client access key id to secret, for SigV4 verification
+	Buckets               []BucketPolicy      //buckets clients may use, empty allows any bucket
+	Backend               string              //upstream store: s3, fs or memory
+	BackendPath           string              //directory of the fs backend
+	Upstream              Upstream            //S3 settings for buckets without their own entry
+	BucketUpstream        map[string]Upstream //per bucket S3 settings
+	Members               *memberlist.Memberlist
+	live                  *sync.RWMutex     //guards the fields Reload can change
+	overrides             map[string]string //command line settings, reapplied by Reload
 }
 
+//CacheDir is a directory cached objects are kept in, typically one per disk
+type CacheDir struct {
+	Path     string //ends with a /
+	Capacity int64  //bytes of cached objects it may hold
+}
+
+//RetentionRule sets how the cache keeps the objects in a bucket under a key prefix.  The most
+//specific matching rule applies: one naming the bucket over one for every bucket, then the
+//longest prefix
+type RetentionRule struct {
+	Bucket         string        //empty for every bucket
+	Prefix         string        //empty for the whole bucket
+	Pinned         bool          //never evicted, though they still count against the capacity
+	Priority       int           //objects with lower priorities are evicted first, 0 by default
+	MaxAge         time.Duration //how long an object may stay cached, 0 for no limit
+	MaxDiskPercent int           //share of DiskCap the rule's objects may take together, 0 for no limit
+	MaxMemPercent  int           //share of MemCap they may take together, 0 for no limit
+}
+
+//Upstream is the S3 service a bucket is proxied to
+type Upstream struct {
+	Endpoint    string              `json:"Endpoint"`  //e.g. http://127.0.0.1:9000 for MinIO, empty for AWS
+	Region      string              `json:"Region"`    //"auto" discovers it with GetBucketLocation
+	PathStyle   bool                `json:"PathStyle"` //bucket in the path rather than the host name
+	Credentials UpstreamCredentials `json:"Credentials"`
+}
+
+//UpstreamCredentials selects where the AWS credentials for an upstream come from
+type UpstreamCredentials struct {
+	Source          string `json:"Source"` //default (SDK chain), static, env, profile or assume-role
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Profile         string `json:"Profile"`
+	RoleARN         string `json:"RoleArn"`
+	ExternalID      string `json:"ExternalId"`
+}
+
+//BucketPolicy lists a bucket clients are allowed to use through s3envoy.  Rules are checked in
+//order and the first one matching the client decides; otherwise the bucket's Access applies
+type BucketPolicy struct {
+	Name     string       `json:"Name"`
+	Prefixes []string     `json:"Prefixes"` //key prefixes allowed, empty for the whole bucket
+	Access   string       `json:"Access"`   //none, read-only or read-write.  Defaults to read-only
+	Rules    []PolicyRule `json:"Rules"`
+}
+
+//PolicyRule overrides a bucket's access for particular clients
+type PolicyRule struct {
+	Identities []string `json:"Identities"` //access key ids, empty matches any client
+	CIDRs      []string `json:"CIDRs"`      //source networks, empty matches any address
+	Prefixes   []string `json:"Prefixes"`   //defaults to the bucket's Prefixes
+	Access     string   `json:"Access"`     //defaults to the bucket's Access
+}
+
+//AccessKey is a client credential s3envoy accepts signed requests from
+type AccessKey struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+}
+
+//cacheDirInput is a CacheDirs entry as read from the config
+type cacheDirInput struct {
+	Path     string `json:"Path"`
+	Capacity Size   `json:"Capacity"`
+}
+
+//retentionRuleInput is a Retention entry as read from the config
+type retentionRuleInput struct {
+	Bucket         string   `json:"Bucket"`
+	Prefix         string   `json:"Prefix"`
+	Pinned         Bool     `json:"Pinned"`
+	Priority       Int      `json:"Priority"`
+	MaxAge         Duration `json:"MaxAge"`
+	MaxDiskPercent Int      `json:"MaxDiskPercent"`
+	MaxMemPercent  Int      `json:"MaxMemPercent"`
+}
+
+//argsInput is the config as read from the file, environment and flags, before it becomes Args
 type argsInput struct {
-	LocalPath      string   `json:"LocalPath"`
-	TotalFiles     string   `json:"TotalFiles"`
-	MemCap         string   `json:"MemCap"`
-	DiskCap        string   `json:"DiskCap"`
-	MaxMemFileSize string   `json:"MaxMemFileSize"`
-	LocalName      string   `json:"LocalName"`
-	Cluster        string   `json:"Cluster"`
-	ClientPort     string   `json:"ClientPort"`
-	HashPort       string   `json:"HashPort"`
-	Peers          []string `json:"Peers"`
+	LocalPath             string               `json:"LocalPath" desc:"directory cached objects are kept in"`
+	TotalFiles            Int                  `json:"TotalFiles" desc:"number of files allowed to be held locally"`
+	MemCap                Size                 `json:"MemCap" desc:"memory available to the cache"`
+	DiskCap               Size                 `json:"DiskCap" desc:"disk space available to the cache"`
+	CacheDirs             []cacheDirInput      `json:"CacheDirs" desc:"directories, one per disk, to keep cached objects in instead of LocalPath.  DiskCap is then their total"`
+	Placement             string               `json:"Placement" desc:"how objects are spread over CacheDirs: hash (consistent hashing weighted by capacity) or free (most free space)"`
+	DirCheckInterval      Duration             `json:"DirCheckInterval" desc:"how often CacheDirs are checked for disk failures, 0 to disable"`
+	DiskHighWatermark     Int                  `json:"DiskHighWatermark" desc:"percent of a cache dir's filesystem in use, by anything, at which objects start being evicted"`
+	DiskLowWatermark      Int                  `json:"DiskLowWatermark" desc:"percent of the filesystem in use eviction brings it back down to"`
+	DiskCriticalWatermark Int                  `json:"DiskCriticalWatermark" desc:"percent of the filesystem in use at which the cache dir takes no new objects and PUTs get 503 SlowDown"`
+	WatermarkInterval     Duration             `json:"WatermarkInterval" desc:"how often filesystem usage is checked against the watermarks, 0 to disable"`
+	Fsync                 string               `json:"Fsync" desc:"when cache files are synced to disk before being renamed into place: always, put (uploads not yet in the backend) or never"`
+	Dedup                 Bool                 `json:"Dedup" desc:"store objects with identical content once on disk and in memory, keyed by SHA-256"`
+	Compress              map[string]string    `json:"Compress" desc:"compression of cached objects by content type, e.g. {\"text/*\": \"zstd\", \"application/json\": \"gzip\"}"`
+	EncryptionKeys        []string             `json:"EncryptionKeys" desc:"base64 AES-256 master keys to encrypt cached files with, best set through S3ENVOY_ENCRYPTIONKEYS.  The first is current, the rest are older ones files may still be encrypted with"`
+	EncryptionKeyFile     string               `json:"EncryptionKeyFile" desc:"file of master keys instead of EncryptionKeys, one base64 key per line, current first"`
+	MaxMemFileSize        Size                 `json:"MaxMemFileSize" desc:"objects smaller than this are also kept in memory"`
+	Retention             []retentionRuleInput `json:"Retention" desc:"rules by Bucket and Prefix: Pinned objects are never evicted, lower Priority ones go first, none stays longer than MaxAge, and together they take at most MaxDiskPercent of DiskCap and MaxMemPercent of MemCap"`
+	PromoteAfter          Int                  `json:"PromoteAfter" desc:"disk hits before an object smaller than MaxMemFileSize is promoted into memory, 0 never"`
+	LocalName             string               `json:"LocalName" desc:"this node's address and hash port as peers know it"`
+	Cluster               Bool                 `json:"Cluster" desc:"share cached objects with Peers through the global hash"`
+	ClientPort            Port                 `json:"ClientPort" desc:"port S3 clients connect to"`
+	HashPort              Port                 `json:"HashPort" desc:"port peers send global hash updates to"`
+	AdminPort             Port                 `json:"AdminPort" desc:"port of the admin API, empty to turn it off"`
+	AdminAddress          string               `json:"AdminAddress" desc:"interface the admin API listens on, only this host can reach it on 127.0.0.1.  Any other address needs an AdminToken"`
+	AdminToken            string               `json:"AdminToken" desc:"token admin API requests must send as Authorization: Bearer, best set through S3ENVOY_ADMINTOKEN"`
+	ScrubInterval         Duration             `json:"ScrubInterval" desc:"how often cached content is rehashed, 0 to disable"`
+	ShutdownTimeout       Duration             `json:"ShutdownTimeout" desc:"how long to wait for requests and uploads to finish on SIGTERM"`
+	ConfigWatch           Duration             `json:"ConfigWatch" desc:"how often to check the config file for changes, 0 to reload on SIGHUP only"`
+	LogLevel              string               `json:"LogLevel" desc:"panic, fatal, error, warn, info or debug"`
+	Peers                 []string             `json:"Peers" desc:"other nodes as address:hashport"`
+	AccessKeys            []AccessKey          `json:"AccessKeys" desc:"client credentials for SigV4 verification, none to accept unsigned requests"`
+	Buckets               []BucketPolicy       `json:"Buckets" desc:"buckets clients may use, empty allows any bucket"`
+	Backend               string               `json:"Backend" desc:"upstream store: s3, fs or memory"`
+	BackendPath           string               `json:"BackendPath" desc:"directory of the fs backend"`
+	Upstream              Upstream             `json:"Upstream" desc:"S3 settings for buckets without their own entry"`
+	BucketUpstream        map[string]Upstream  `json:"BucketUpstream" desc:"per bucket S3 settings"`
+}
+
+//EnvPrefix of the environment variables that override config file settings, e.g. S3ENVOY_MEMCAP
+const EnvPrefix = "S3ENVOY_"
+
+//defaults for everything a config file may leave out
+func defaults() *argsInput {
+	return &argsInput{
+		TotalFiles:            10,
+		MemCap:                100 << 20,
+		DiskCap:               500 << 20,
+		Placement:             "hash",
+		DirCheckInterval:      Duration(30 * time.Second),
+		DiskHighWatermark:     90,
+		DiskLowWatermark:      80,
+		DiskCriticalWatermark: 98,
+		WatermarkInterval:     Duration(10 * time.Second),
+		Fsync:                 "put",
+		MaxMemFileSize:        1 << 20,
+		PromoteAfter:          2,
+		LocalName:             "127.0.0.1:9081",
+		ClientPort:            "8081",
+		HashPort:              "9081",
+		AdminPort:             "7081", //set to "" to turn the admin API off
+		AdminAddress:          "127.0.0.1",
+		ScrubInterval:         Duration(time.Hour),
+		ShutdownTimeout:       Duration(30 * time.Second),
+		LogLevel:              "debug",
+		Backend:               "s3",
+		Upstream:              Upstream{Region: "us-west-1"}, //the region s3envoy always used
+	}
 }
 
 func (args *Args) CheckMemberAlive(node string) bool {
@@ -50,93 +221,350 @@ func (args *Args) CheckMemberAlive(node string) bool {
 	return false
 }
 
-//Load function to load config file and return struct with args
-func Load(conf string) *Args {
+//Load function to load config file and return struct with args.  Settings are the defaults,
+//overridden by the config file, then by S3ENVOY_* environment variables and finally by
+//overrides, which map setting names to values from the command line
+func Load(conf string, overrides map[string]string) (*Args, error) {
+	new, errs := load(conf, overrides, true)
+	if len(errs) > 0 {
+		return nil, joinErrors(errs)
+	}
+	log.Debugln("Config file Args:", new)
+	return new, nil
+}
+
+//Validate checks a config file on its own, without the environment or command line.  It
+//returns the args it would load along with every problem found, rather than stopping at the first
+func Validate(conf string) (*Args, []error) {
+	return load(conf, nil, false)
+}
+
+//Effective returns the merged config Load would use, as JSON with secrets redacted
+func Effective(conf string, overrides map[string]string) ([]byte, error) {
+	in, errs := read(conf, overrides, true)
+	if len(errs) > 0 {
+		return nil, joinErrors(errs)
+	}
+	redacted := "REDACTED"
+	for i := range in.AccessKeys {
+		in.AccessKeys[i].SecretAccessKey = redacted
+	}
+	for i := range in.EncryptionKeys {
+		in.EncryptionKeys[i] = redacted
+	}
+	if in.AdminToken != "" {
+		in.AdminToken = redacted
+	}
+	redact := func(up *Upstream) {
+		if up.Credentials.SecretAccessKey != "" {
+			up.Credentials.SecretAccessKey = redacted
+		}
+		if up.Credentials.SessionToken != "" {
+			up.Credentials.SessionToken = redacted
+		}
+	}
+	redact(&in.Upstream)
+	for name, up := range in.BucketUpstream {
+		redact(&up)
+		in.BucketUpstream[name] = up
+	}
+	return json.MarshalIndent(in, "", "  ")
+}
+
+func load(conf string, overrides map[string]string, env bool) (*Args, []error) {
+	in, errs := read(conf, overrides, env)
+	args := fromInput(in)
+	args.overrides = overrides
+	return args, errs
+}
+
+//read the settings from each source in order, then check them
+func read(conf string, overrides map[string]string, env bool) (*argsInput, []error) {
+	in := defaults()
+	errs := in.readFile(conf)
+	if env == true {
+		errs = append(errs, in.readEnv()...)
+	}
+	for name, value := range overrides {
+		if err := in.set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("flag %s: %v", name, err))
+		}
+	}
+	errs = append(errs, in.check()...)
+	return in, errs
+}
+
+//fields maps each setting's name to the field holding it
+func (in *argsInput) fields() map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(in).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		fields[v.Type().Field(i).Tag.Get("json")] = v.Field(i)
+	}
+	return fields
+}
 
-	configFile, err := os.Open(conf)
-	defer configFile.Close()
+//readFile overlays the config file on in, reporting unknown settings and values of the wrong type
+func (in *argsInput) readFile(conf string) []error {
+	data, err := ioutil.ReadFile(conf)
 	if err != nil {
-		log.Fatalln(err)
+		return []error{err}
+	}
+	if data, err = toJSON(conf, data); err != nil {
+		return []error{fmt.Errorf("%s: %v", conf, err)}
 	}
-	args := new(argsInput)
-	json.NewDecoder(configFile).Decode(args)
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return []error{fmt.Errorf("%s: %v", conf, err)}
+	}
+	var names []string
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	var localPath string
-	var totalFiles int
-	var memCap string
-	var diskCap string
-	var maxMemFileSize string
-	//var peers []string
-	var cluster bool
-	var clientPort string
-	var localName string
-	var hashPort string
+	var errs []error
+	fields := in.fields()
+	for _, name := range names {
+		value := raw[name]
+		field, ok := fields[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting", name))
+			continue
+		}
+		if errU := decodeStrict(value, field.Addr().Interface()); errU != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, errU))
+		}
+	}
+	return errs
+}
 
-	if args.LocalPath == "" {
-		localPath = "/Users/bparli/tmp/"
-	} else {
-		localPath = args.LocalPath + "/"
+//readEnv overlays S3ENVOY_<SETTING> environment variables, e.g. S3ENVOY_MEMCAP=2G
+func (in *argsInput) readEnv() []error {
+	var errs []error
+	for name := range in.fields() {
+		env := EnvPrefix + strings.ToUpper(name)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := in.set(name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", env, err))
+			}
+		}
 	}
+	return errs
+}
 
-	if args.TotalFiles == "" {
-		totalFiles = 10
-	} else {
-		qsize, _ := strconv.Atoi(args.TotalFiles)
-		totalFiles = qsize
+//set a setting, matched case insensitively, from its string form.  Lists are comma separated
+//and structured settings such as Buckets are given as JSON
+func (in *argsInput) set(name string, value string) error {
+	for fieldName, field := range in.fields() {
+		if strings.EqualFold(fieldName, name) == false {
+			continue
+		}
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(value)
+			return nil
+		case []string:
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+			return nil
+		}
+		//numbers and JSON go in as they are, anything else is taken as a JSON string
+		if err := json.Unmarshal([]byte(value), field.Addr().Interface()); err == nil {
+			return nil
+		}
+		quoted, _ := json.Marshal(value)
+		return json.Unmarshal(quoted, field.Addr().Interface())
 	}
+	return fmt.Errorf("unknown setting")
+}
 
-	if args.LocalName == "" {
-		localName = "127.0.0.1:9081"
-	} else {
-		localName = args.LocalName
+//check the settings that are valid on their own but not together, or not for this program
+func (in *argsInput) check() []error {
+	var errs []error
+	if in.LocalPath == "" {
+		errs = append(errs, fmt.Errorf("LocalPath: required"))
+	}
+	if in.MaxMemFileSize > in.MemCap {
+		errs = append(errs, fmt.Errorf("MaxMemFileSize: %d is larger than MemCap %d", in.MaxMemFileSize, in.MemCap))
+	}
+	if _, err := log.ParseLevel(in.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("LogLevel: %v", err))
+	}
+	if in.Cluster == true && len(in.Peers) == 0 {
+		errs = append(errs, fmt.Errorf("Peers: a cluster needs at least one peer"))
+	}
+	if in.ClientPort == "" || in.HashPort == "" {
+		errs = append(errs, fmt.Errorf("ClientPort and HashPort can't be empty"))
+	}
+	switch in.Backend {
+	case "s3", "memory":
+	case "fs":
+		if in.BackendPath == "" {
+			errs = append(errs, fmt.Errorf("BackendPath: required by the fs backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Backend: unknown backend %q, expecting s3, fs or memory", in.Backend))
+	}
+	switch in.Placement {
+	case "hash", "free":
+	default:
+		errs = append(errs, fmt.Errorf("Placement: unknown placement %q, expecting hash or free", in.Placement))
+	}
+	if in.DiskLowWatermark >= in.DiskHighWatermark || in.DiskHighWatermark > in.DiskCriticalWatermark || in.DiskCriticalWatermark > 100 {
+		errs = append(errs, fmt.Errorf("DiskLowWatermark, DiskHighWatermark and DiskCriticalWatermark: expecting low < high <= critical <= 100, got %d, %d and %d",
+			in.DiskLowWatermark, in.DiskHighWatermark, in.DiskCriticalWatermark))
+	}
+	//the admin API can purge, drain and pin, past the SigV4 check and the bucket policy
+	if ip := net.ParseIP(in.AdminAddress); in.AdminPort != "" && in.AdminToken == "" && in.AdminAddress != "localhost" && (ip == nil || ip.IsLoopback() == false) {
+		errs = append(errs, fmt.Errorf("AdminAddress: the admin API can only listen on %q, reachable from other hosts, with an AdminToken", in.AdminAddress))
+	}
+	switch in.Fsync {
+	case "always", "put", "never":
+	default:
+		errs = append(errs, fmt.Errorf("Fsync: unknown policy %q, expecting always, put or never", in.Fsync))
+	}
+	for contentType, encoding := range in.Compress {
+		if encoding != "gzip" && encoding != "zstd" {
+			errs = append(errs, fmt.Errorf("Compress[%s]: unknown compression %q, expecting gzip or zstd", contentType, encoding))
+		}
 	}
+	dirs := make(map[string]bool)
+	for i, dir := range in.CacheDirs {
+		path := strings.TrimSuffix(dir.Path, "/") + "/"
+		if dir.Path == "" || dir.Capacity == 0 {
+			errs = append(errs, fmt.Errorf("CacheDirs[%d]: needs both Path and Capacity", i))
+		} else if dirs[path] == true {
+			errs = append(errs, fmt.Errorf("CacheDirs[%d]: %s is listed twice", i, dir.Path))
+		}
+		dirs[path] = true
+	}
+	for i, key := range in.AccessKeys {
+		if key.AccessKeyID == "" || key.SecretAccessKey == "" {
+			errs = append(errs, fmt.Errorf("AccessKeys[%d]: needs both AccessKeyId and SecretAccessKey", i))
+		}
+	}
+	if _, err := in.masterKeys(); err != nil {
+		errs = append(errs, err)
+	}
+	rules := make(map[string]bool)
+	for i, rule := range in.Retention {
+		if rule.MaxAge < 0 || rule.MaxDiskPercent < 0 || rule.MaxDiskPercent > 100 || rule.MaxMemPercent < 0 || rule.MaxMemPercent > 100 {
+			errs = append(errs, fmt.Errorf("Retention[%d]: MaxAge can't be negative and the percentages must be between 0 and 100", i))
+		}
+		if rules[rule.Bucket+"/"+rule.Prefix] == true {
+			errs = append(errs, fmt.Errorf("Retention[%d]: there's already a rule for bucket %q prefix %q", i, rule.Bucket, rule.Prefix))
+		}
+		rules[rule.Bucket+"/"+rule.Prefix] = true
+	}
+	return errs
+}
 
-	if args.MemCap == "" {
-		memCap = "100M"
-	} else {
-		memCap = args.MemCap
+//masterKeys decodes EncryptionKeys, or the keys in EncryptionKeyFile
+func (in *argsInput) masterKeys() ([][]byte, error) {
+	encoded := in.EncryptionKeys
+	setting := "EncryptionKeys"
+	if in.EncryptionKeyFile != "" {
+		if len(in.EncryptionKeys) > 0 {
+			return nil, fmt.Errorf("EncryptionKeys and EncryptionKeyFile: only one of them can be set")
+		}
+		data, err := ioutil.ReadFile(in.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("EncryptionKeyFile: %v", err)
+		}
+		encoded = nil
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && strings.HasPrefix(line, "#") == false {
+				encoded = append(encoded, line)
+			}
+		}
+		setting = "EncryptionKeyFile"
 	}
-	memCap2, _ := bytefmt.ToBytes(memCap)
+	var keys [][]byte
+	for i, key := range encoded {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("%s[%d]: expecting a base64 encoded 32 byte key", setting, i)
+		}
+		keys = append(keys, decoded)
+	}
+	return keys, nil
+}
 
-	if args.DiskCap == "" {
-		diskCap = "500M"
-	} else {
-		diskCap = args.DiskCap
+func joinErrors(errs []error) error {
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
 	}
-	diskCap2, _ := bytefmt.ToBytes(diskCap)
+	sort.Strings(msgs)
+	return fmt.Errorf("invalid config: %s", strings.Join(msgs, "; "))
+}
 
-	if args.MaxMemFileSize == "" {
-		maxMemFileSize = "1M"
-	} else {
-		maxMemFileSize = args.MaxMemFileSize
+//fromInput converts the checked settings into Args
+func fromInput(in *argsInput) *Args {
+	accessKeys := make(map[string]string)
+	for _, key := range in.AccessKeys {
+		accessKeys[key.AccessKeyID] = key.SecretAccessKey
+	}
+	if len(accessKeys) == 0 {
+		log.Warnln("No AccessKeys configured, client requests will not be authenticated")
 	}
-	maxMemFileSize2, _ := bytefmt.ToBytes(maxMemFileSize)
 
-	if args.ClientPort == "" {
-		clientPort = "8081"
-	} else {
-		clientPort = args.ClientPort
+	bucketUpstream := make(map[string]Upstream)
+	for name, up := range in.BucketUpstream {
+		if up.Region == "" {
+			up.Region = "auto"
+		}
+		bucketUpstream[name] = up
 	}
 
-	if args.HashPort == "" {
-		hashPort = "9081"
-	} else {
-		hashPort = args.HashPort
+	masterKeys, _ := in.masterKeys()
+	var retention []RetentionRule
+	for _, rule := range in.Retention {
+		retention = append(retention, RetentionRule{Bucket: rule.Bucket, Prefix: rule.Prefix, Pinned: bool(rule.Pinned),
+			Priority: int(rule.Priority), MaxAge: time.Duration(rule.MaxAge),
+			MaxDiskPercent: int(rule.MaxDiskPercent), MaxMemPercent: int(rule.MaxMemPercent)})
 	}
 
-	if args.Cluster == "" || args.Cluster == "False" {
-		cluster = false
-		//peers = []string{}
-	} else if args.Cluster == "True" {
-		cluster = true
+	localPath := strings.TrimSuffix(in.LocalPath, "/") + "/"
+	var cacheDirs []CacheDir
+	if len(in.CacheDirs) > 0 {
+		in.DiskCap = 0
+		for _, dir := range in.CacheDirs {
+			cacheDirs = append(cacheDirs, CacheDir{Path: strings.TrimSuffix(dir.Path, "/") + "/", Capacity: int64(dir.Capacity)})
+			in.DiskCap += dir.Capacity
+		}
 	}
 
 	new := &Args{LocalPath: localPath,
-		TotalFiles: totalFiles, MemCap: int64(memCap2),
-		DiskCap: int64(diskCap2), MaxMemFileSize: int64(maxMemFileSize2),
-		Peers: args.Peers, LocalName: localName, Cluster: cluster,
-		ClientPort: clientPort, HashPort: hashPort}
-
-	log.Debugln("Config file Args:", new)
+		TotalFiles: int(in.TotalFiles), MemCap: int64(in.MemCap),
+		DiskCap: int64(in.DiskCap), CacheDirs: cacheDirs, Placement: in.Placement,
+		DirCheckInterval:  time.Duration(in.DirCheckInterval),
+		DiskHighWatermark: int(in.DiskHighWatermark), DiskLowWatermark: int(in.DiskLowWatermark),
+		DiskCriticalWatermark: int(in.DiskCriticalWatermark), WatermarkInterval: time.Duration(in.WatermarkInterval),
+		Fsync: in.Fsync, Dedup: bool(in.Dedup), Compress: in.Compress, EncryptionKeys: masterKeys, MaxMemFileSize: int64(in.MaxMemFileSize),
+		Retention:    retention,
+		PromoteAfter: int(in.PromoteAfter),
+		Peers:        in.Peers, LocalName: in.LocalName, Cluster: bool(in.Cluster),
+		ClientPort: string(in.ClientPort), HashPort: string(in.HashPort), AdminPort: string(in.AdminPort),
+		AdminAddress: in.AdminAddress, AdminToken: in.AdminToken,
+		ScrubInterval: time.Duration(in.ScrubInterval), ShutdownTimeout: time.Duration(in.ShutdownTimeout),
+		AccessKeys: accessKeys, Buckets: in.Buckets,
+		Backend: in.Backend, BackendPath: in.BackendPath,
+		Upstream: in.Upstream, BucketUpstream: bucketUpstream,
+		ConfigWatch: time.Duration(in.ConfigWatch), LogLevel: in.LogLevel, live: &sync.RWMutex{}}
 	return new
 }
+
+//UpstreamFor returns the S3 settings for a bucket
+func (args *Args) UpstreamFor(bucket string) Upstream {
+	if up, ok := args.BucketUpstream[bucket]; ok {
+		return up
+	}
+	return args.Upstream
+}
@@ -0,0 +1,114 @@
+package loadArgs
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//MaxMemSize is MaxMemFileSize, safe to read while a reload may be changing it
+func (args *Args) MaxMemSize() int64 {
+	args.live.RLock()
+	defer args.live.RUnlock()
+	return args.MaxMemFileSize
+}
+
+//PeerList is Peers, safe to read while a reload may be changing it
+func (args *Args) PeerList() []string {
+	args.live.RLock()
+	defer args.live.RUnlock()
+	return args.Peers
+}
+
+//MasterKeys is EncryptionKeys, safe to read while a reload may be rotating them
+func (args *Args) MasterKeys() [][]byte {
+	args.live.RLock()
+	defer args.live.RUnlock()
+	return args.EncryptionKeys
+}
+
+//Reload rereads the config file and applies MemCap, DiskCap, MaxMemFileSize, Peers, LogLevel
+//and EncryptionKeys, which can be rotated but not turned on or off.  Nothing is applied unless the whole file is valid and every other field is
+//unchanged, since those only take effect on a restart.  resize is called with the new MemCap
+//and DiskCap before the lock on the live settings is released, so nothing sees the new
+//settings with the old capacities.  It returns the peers that were added
+func (args *Args) Reload(conf string, resize func(memCap int64, diskCap int64)) ([]string, error) {
+	next, errs := load(conf, args.overrides, true)
+	if len(errs) > 0 {
+		return nil, joinErrors(errs)
+	}
+
+	fixed := map[string][2]interface{}{
+		"LocalPath":             {args.LocalPath, next.LocalPath},
+		"TotalFiles":            {args.TotalFiles, next.TotalFiles},
+		"CacheDirs":             {args.CacheDirs, next.CacheDirs},
+		"Placement":             {args.Placement, next.Placement},
+		"DirCheckInterval":      {args.DirCheckInterval, next.DirCheckInterval},
+		"DiskHighWatermark":     {args.DiskHighWatermark, next.DiskHighWatermark},
+		"DiskLowWatermark":      {args.DiskLowWatermark, next.DiskLowWatermark},
+		"DiskCriticalWatermark": {args.DiskCriticalWatermark, next.DiskCriticalWatermark},
+		"WatermarkInterval":     {args.WatermarkInterval, next.WatermarkInterval},
+		"Fsync":                 {args.Fsync, next.Fsync},
+		"Dedup":                 {args.Dedup, next.Dedup},
+		"Compress":              {args.Compress, next.Compress},
+		"Retention":             {args.Retention, next.Retention},
+		"PromoteAfter":          {args.PromoteAfter, next.PromoteAfter},
+		"LocalName":             {args.LocalName, next.LocalName},
+		"Cluster":               {args.Cluster, next.Cluster},
+		"ClientPort":            {args.ClientPort, next.ClientPort},
+		"HashPort":              {args.HashPort, next.HashPort},
+		"AdminPort":             {args.AdminPort, next.AdminPort},
+		"AdminAddress":          {args.AdminAddress, next.AdminAddress},
+		"AdminToken":            {args.AdminToken, next.AdminToken},
+		"ScrubInterval":         {args.ScrubInterval, next.ScrubInterval},
+		"ShutdownTimeout":       {args.ShutdownTimeout, next.ShutdownTimeout},
+		"ConfigWatch":           {args.ConfigWatch, next.ConfigWatch},
+		"AccessKeys":            {args.AccessKeys, next.AccessKeys},
+		"Buckets":               {args.Buckets, next.Buckets},
+		"Backend":               {args.Backend, next.Backend},
+		"BackendPath":           {args.BackendPath, next.BackendPath},
+		"Upstream":              {args.Upstream, next.Upstream},
+		"BucketUpstream":        {args.BucketUpstream, next.BucketUpstream},
+	}
+	var changed []string
+	for name, values := range fixed {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			changed = append(changed, name)
+		}
+	}
+	if (len(args.MasterKeys()) == 0) != (len(next.EncryptionKeys) == 0) {
+		changed = append(changed, "Encryption")
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return nil, fmt.Errorf("%s can't be changed without a restart", strings.Join(changed, ", "))
+	}
+	level, _ := log.ParseLevel(next.LogLevel)
+
+	args.live.Lock()
+	defer args.live.Unlock()
+	var added []string
+	for _, peer := range next.Peers {
+		found := false
+		for _, old := range args.Peers {
+			if old == peer {
+				found = true
+			}
+		}
+		if found == false {
+			added = append(added, peer)
+		}
+	}
+	args.MemCap = next.MemCap
+	args.DiskCap = next.DiskCap
+	args.MaxMemFileSize = next.MaxMemFileSize
+	args.Peers = next.Peers
+	args.LogLevel = next.LogLevel
+	args.EncryptionKeys = next.EncryptionKeys
+	log.SetLevel(level)
+	resize(args.MemCap, args.DiskCap)
+	return added, nil
+}
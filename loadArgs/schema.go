@@ -0,0 +1,93 @@
+package loadArgs
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+//schemaTypes are the JSON Schemas of the config's own value types
+var schemaTypes = map[reflect.Type]map[string]interface{}{
+	reflect.TypeOf(Size(0)): {"oneOf": []interface{}{
+		map[string]interface{}{"type": "integer", "minimum": 0},
+		map[string]interface{}{"type": "string", "pattern": `^[0-9.]+ *([KMGT]i?B?|B)$`},
+	}, "description": "bytes, or a size like \"100M\""},
+	reflect.TypeOf(Int(0)): {"oneOf": []interface{}{
+		map[string]interface{}{"type": "integer", "minimum": 0},
+		map[string]interface{}{"type": "string", "pattern": `^[0-9]+$`},
+	}},
+	reflect.TypeOf(Bool(false)): {"oneOf": []interface{}{
+		map[string]interface{}{"type": "boolean"},
+		map[string]interface{}{"type": "string", "enum": []string{"true", "false", "True", "False", "TRUE", "FALSE", "t", "f", "T", "F", "1", "0"}},
+	}},
+	reflect.TypeOf(Duration(0)): {"oneOf": []interface{}{
+		map[string]interface{}{"type": "number", "minimum": 0},
+		map[string]interface{}{"type": "string", "pattern": `^([0-9.]+(ns|us|µs|ms|s|m|h))+$|^0$`},
+	}, "description": "seconds, or a duration like \"1h30m\""},
+	reflect.TypeOf(Port("")): {"oneOf": []interface{}{
+		map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 65535},
+		map[string]interface{}{"type": "string", "pattern": `^[0-9]*$`},
+	}},
+}
+
+//schemaOf builds the JSON Schema of a Go type from its fields, json tags and desc tags
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if s, ok := schemaTypes[t]; ok {
+		copied := make(map[string]interface{}, len(s))
+		for k, v := range s {
+			copied[k] = v
+		}
+		return copied
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = f.Name
+			}
+			prop := schemaOf(f.Type)
+			if desc := f.Tag.Get("desc"); desc != "" {
+				prop["description"] = desc
+			}
+			props[name] = prop
+		}
+		return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	return map[string]interface{}{}
+}
+
+//Schema returns the JSON Schema of the config file, with the defaults filled in
+func Schema() ([]byte, error) {
+	schema := schemaOf(reflect.TypeOf(argsInput{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "s3envoy config"
+	schema["required"] = []string{"LocalPath"}
+
+	var defs map[string]interface{}
+	data, err := json.Marshal(defaults())
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(data, &defs)
+	props := schema["properties"].(map[string]interface{})
+	for name, value := range defs {
+		if value == nil || value == "" {
+			continue
+		}
+		props[name].(map[string]interface{})["default"] = value
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
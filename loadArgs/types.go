@@ -0,0 +1,142 @@
+package loadArgs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pivotal-golang/bytefmt"
+)
+
+//The config file types below accept either a JSON string, as older config files have
+//everywhere, or the natural JSON type.  Anything else is an error rather than a default
+
+//Size in bytes, either a number or a string like "100M"
+type Size int64
+
+//UnmarshalJSON reads a byte count or a bytefmt size
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		if n < 0 {
+			return fmt.Errorf("size %d is negative", n)
+		}
+		*s = Size(n)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expecting a size like \"100M\" or a number of bytes, got %s", data)
+	}
+	n2, err := bytefmt.ToBytes(str)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: %v", str, err)
+	}
+	*s = Size(n2)
+	return nil
+}
+
+//MarshalJSON writes the size as a number of bytes
+func (s Size) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int64(s))
+}
+
+//Int is a non-negative number, or a string holding one
+type Int int
+
+//UnmarshalJSON reads a number or numeric string
+func (i *Int) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		var str string
+		if errS := json.Unmarshal(data, &str); errS != nil {
+			return fmt.Errorf("expecting a number, got %s", data)
+		}
+		if n, err = strconv.Atoi(str); err != nil {
+			return fmt.Errorf("expecting a number, got %q", str)
+		}
+	}
+	if n < 0 {
+		return fmt.Errorf("%d is negative", n)
+	}
+	*i = Int(n)
+	return nil
+}
+
+//Bool is true or false, or a string strconv.ParseBool understands such as "True"
+type Bool bool
+
+//UnmarshalJSON reads a boolean or boolean string
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	var v bool
+	if err := json.Unmarshal(data, &v); err == nil {
+		*b = Bool(v)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expecting true or false, got %s", data)
+	}
+	v, err := strconv.ParseBool(str)
+	if err != nil {
+		return fmt.Errorf("expecting true or false, got %q", str)
+	}
+	*b = Bool(v)
+	return nil
+}
+
+//Duration is a string like "1h30m" or a number of seconds
+type Duration time.Duration
+
+//UnmarshalJSON reads a duration string or a number of seconds
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var secs float64
+	if err := json.Unmarshal(data, &secs); err == nil {
+		if secs < 0 {
+			return fmt.Errorf("duration %v is negative", secs)
+		}
+		*d = Duration(secs * float64(time.Second))
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expecting a duration like \"1h\" or a number of seconds, got %s", data)
+	}
+	v, err := time.ParseDuration(str)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", str, err)
+	}
+	if v < 0 {
+		return fmt.Errorf("duration %q is negative", str)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+//MarshalJSON writes the duration as a string like "1h0m0s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+//Port is a TCP port number or string, "" where a listener can be turned off
+type Port string
+
+//UnmarshalJSON reads a port number or string
+func (p *Port) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		var n int
+		if errN := json.Unmarshal(data, &n); errN != nil {
+			return fmt.Errorf("expecting a port number, got %s", data)
+		}
+		str = strconv.Itoa(n)
+	}
+	if str != "" {
+		if n, err := strconv.Atoi(str); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %q", str)
+		}
+	}
+	*p = Port(str)
+	return nil
+}
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//Sources a request can be served from
+const (
+	SourceMem  = "mem"
+	SourceDisk = "disk"
+	SourcePeer = "peer"
+	SourceS3   = "s3"
+	SourceNone = "none" //errors, uploads and other requests that don't serve an object
+)
+
+var (
+	//Requests by method, status code and where the object came from
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "s3envoy",
+		Name:      "requests_total",
+		Help:      "Client requests by method, status and source.",
+	}, []string{"method", "status", "source"})
+
+	//BytesServed to clients by source
+	BytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "s3envoy",
+		Name:      "served_bytes_total",
+		Help:      "Bytes written to clients by source.",
+	}, []string{"source"})
+
+	//RequestDuration of client requests
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "s3envoy",
+		Name:      "request_duration_seconds",
+		Help:      "Client request latency.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "source"})
+
+	//UpstreamDuration of calls to the backend
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "s3envoy",
+		Name:      "upstream_duration_seconds",
+		Help:      "Latency of backend (S3) calls by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	//CacheFiles held in the local cache
+	CacheFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "s3envoy",
+		Name:      "cache_files",
+		Help:      "Objects in the local cache.",
+	})
+
+	//CacheBytes in use by tier (mem, disk)
+	CacheBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "s3envoy",
+		Name:      "cache_bytes",
+		Help:      "Bytes used by the local cache per tier.",
+	}, []string{"tier"})
+
+	//CacheCapacity by tier, from MemCap and DiskCap
+	CacheCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "s3envoy",
+		Name:      "cache_capacity_bytes",
+		Help:      "Configured capacity of the local cache per tier.",
+	}, []string{"tier"})
+
+	//CacheDirUp is 1 for a healthy cache directory, 0 for a failed one
+	CacheDirUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "s3envoy",
+		Name:      "cache_dir_up",
+		Help:      "Whether a cache directory passed its last health check.",
+	}, []string{"dir"})
+
+	//CacheDirBytes in use per cache directory
+	CacheDirBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "s3envoy",
+		Name:      "cache_dir_bytes",
+		Help:      "Bytes of cached objects per cache directory.",
+	}, []string{"dir"})
+
+	//CacheDirFSUsed is how full the filesystem of a cache directory is, as a ratio
+	CacheDirFSUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "s3envoy",
+		Name:      "cache_dir_fs_used_ratio",
+		Help:      "Fraction of a cache directory's filesystem in use, by anything.",
+	}, []string{"dir"})
+
+	//Evictions from the local cache
+	Evictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "s3envoy",
+		Name:      "evictions_total",
+		Help:      "Objects evicted from the local cache.",
+	})
+
+	//Promotions of disk cached objects into memory
+	Promotions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "s3envoy",
+		Name:      "promotions_total",
+		Help:      "Objects promoted from the disk tier into memory.",
+	})
+
+	//Demotions of objects out of memory, they stay cached on disk
+	Demotions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "s3envoy",
+		Name:      "demotions_total",
+		Help:      "Objects dropped from the memory tier to make room, still cached on disk.",
+	})
+
+	//GlobalHashSize is the number of entries in the global hash table
+	GlobalHashSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "s3envoy",
+		Name:      "global_hash_entries",
+		Help:      "Entries in this node's view of the global hash table.",
+	})
+
+	//PeerUpdateFailures sending global hash updates to peers
+	PeerUpdateFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "s3envoy",
+		Name:      "peer_update_failures_total",
+		Help:      "Global hash updates that could not be sent to a peer.",
+	})
+
+	//UploadBacklog is the number of background uploads not yet finished
+	UploadBacklog = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "s3envoy",
+		Name:      "upload_backlog",
+		Help:      "Background uploads to the backend in progress or waiting to retry.",
+	})
+
+	//UploadRetries of failed background uploads
+	UploadRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "s3envoy",
+		Name:      "upload_retries_total",
+		Help:      "Background uploads retried after a failure.",
+	})
+
+	//UploadFailures of background uploads that gave up
+	UploadFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "s3envoy",
+		Name:      "upload_failures_total",
+		Help:      "Background uploads that failed after all retries.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(Requests, BytesServed, RequestDuration, UpstreamDuration,
+		CacheFiles, CacheBytes, CacheCapacity, CacheDirUp, CacheDirBytes, CacheDirFSUsed, Evictions, Promotions, Demotions, GlobalHashSize,
+		PeerUpdateFailures, UploadBacklog, UploadRetries, UploadFailures)
+}
+
+//Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,138 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"s3envoy/loadArgs"
+	"strings"
+)
+
+//Access levels a client can have on a bucket or prefix
+const (
+	None      = "none"
+	ReadOnly  = "read-only"
+	ReadWrite = "read-write"
+)
+
+type grant struct {
+	prefixes []string
+	access   string
+}
+
+type rule struct {
+	identities map[string]bool
+	networks   []*net.IPNet
+	grant
+}
+
+type bucket struct {
+	rules []rule
+	grant
+}
+
+//Policy is the compiled bucket allowlist from the config file
+type Policy struct {
+	buckets map[string]*bucket
+}
+
+//New compiles the bucket policies, checking access levels and CIDRs
+func New(policies []loadArgs.BucketPolicy) (*Policy, error) {
+	p := &Policy{buckets: make(map[string]*bucket)}
+	for _, bp := range policies {
+		if bp.Name == "" {
+			return nil, fmt.Errorf("bucket policy without a Name")
+		}
+		access, err := checkAccess(bp.Access, ReadOnly)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %s: %v", bp.Name, err)
+		}
+		b := &bucket{grant: grant{prefixes: bp.Prefixes, access: access}}
+		for i, pr := range bp.Rules {
+			r := rule{identities: make(map[string]bool)}
+			r.prefixes = pr.Prefixes
+			if len(r.prefixes) == 0 {
+				r.prefixes = bp.Prefixes
+			}
+			if r.access, err = checkAccess(pr.Access, access); err != nil {
+				return nil, fmt.Errorf("bucket %s rule %d: %v", bp.Name, i, err)
+			}
+			for _, id := range pr.Identities {
+				r.identities[id] = true
+			}
+			for _, cidr := range pr.CIDRs {
+				_, network, errC := net.ParseCIDR(cidr)
+				if errC != nil {
+					return nil, fmt.Errorf("bucket %s rule %d: %v", bp.Name, i, errC)
+				}
+				r.networks = append(r.networks, network)
+			}
+			b.rules = append(b.rules, r)
+		}
+		p.buckets[bp.Name] = b
+	}
+	return p, nil
+}
+
+func checkAccess(access string, def string) (string, error) {
+	switch access {
+	case "":
+		return def, nil
+	case None, ReadOnly, ReadWrite:
+		return access, nil
+	}
+	return "", fmt.Errorf("unknown Access %q, expecting %s, %s or %s", access, None, ReadOnly, ReadWrite)
+}
+
+//Allowed reports whether the client may read, or write if write is set, the key.  identity is
+//the access key id the request was signed with and remoteAddr the client's host:port
+func (p *Policy) Allowed(identity string, remoteAddr string, bucketName string, key string, write bool) bool {
+	b, ok := p.buckets[bucketName]
+	if !ok {
+		return false
+	}
+	g := b.grant
+	ip := net.ParseIP(remoteAddr)
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = net.ParseIP(host)
+	}
+	for _, r := range b.rules {
+		if r.matches(identity, ip) {
+			g = r.grant
+			break
+		}
+	}
+	return g.allows(key, write)
+}
+
+func (r *rule) matches(identity string, ip net.IP) bool {
+	if len(r.identities) > 0 && !r.identities[identity] {
+		return false
+	}
+	if len(r.networks) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *grant) allows(key string, write bool) bool {
+	if g.access == None || (write && g.access != ReadWrite) {
+		return false
+	}
+	if len(g.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range g.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package policy
+
+import (
+	"s3envoy/loadArgs"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	p, err := New([]loadArgs.BucketPolicy{
+		{Name: "public"},
+		{Name: "shared", Prefixes: []string{"data/"}, Access: ReadWrite, Rules: []loadArgs.PolicyRule{
+			//first match wins, so the deny for the contractor comes before the office network
+			{Identities: []string{"CONTRACTOR"}, Access: None},
+			{CIDRs: []string{"10.1.0.0/16", "fd00::/8"}, Prefixes: []string{"data/", "logs/"}},
+			{Identities: []string{"AUDITOR"}, Access: ReadOnly},
+			{Identities: []string{"ADMIN"}, CIDRs: []string{"192.168.0.0/24"}, Prefixes: []string{""}},
+		}},
+		{Name: "closed", Access: None, Rules: []loadArgs.PolicyRule{
+			{Identities: []string{"BACKUP"}, Access: ReadOnly, Prefixes: []string{"nightly/"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		identity string
+		addr     string
+		bucket   string
+		key      string
+		write    bool
+		want     bool
+	}{
+		{"unlisted bucket", "ADMIN", "192.168.0.5:1234", "other", "data/a", false, false},
+		{"default access is read-only", "", "1.2.3.4:1", "public", "any/key", false, true},
+		{"default access can't write", "", "1.2.3.4:1", "public", "any/key", true, false},
+
+		{"bucket grant read", "ALICE", "1.2.3.4:1", "shared", "data/a", false, true},
+		{"bucket grant write", "ALICE", "1.2.3.4:1", "shared", "data/a", true, true},
+		{"bucket grant outside its prefixes", "ALICE", "1.2.3.4:1", "shared", "logs/a", false, false},
+
+		{"deny rule beats bucket grant", "CONTRACTOR", "1.2.3.4:1", "shared", "data/a", false, false},
+		{"deny rule beats a later network rule", "CONTRACTOR", "10.1.2.3:1", "shared", "logs/a", false, false},
+		{"network rule widens prefixes", "ALICE", "10.1.2.3:1", "shared", "logs/a", true, true},
+		{"network rule by ipv6", "ALICE", "[fd00::1]:1", "shared", "logs/a", false, true},
+		{"network rule without a port", "ALICE", "10.1.2.3", "shared", "logs/a", false, true},
+		{"outside the network", "ALICE", "10.2.0.1:1", "shared", "logs/a", false, false},
+		{"network rule is matched before the auditor rule", "AUDITOR", "10.1.2.3:1", "shared", "data/a", true, true},
+		{"auditor rule takes away write", "AUDITOR", "1.2.3.4:1", "shared", "data/a", true, false},
+		{"auditor rule keeps the bucket prefixes", "AUDITOR", "1.2.3.4:1", "shared", "logs/a", false, false},
+		{"identity and network both have to match", "ADMIN", "1.2.3.4:1", "shared", "other/a", true, false},
+		{"identity and network match", "ADMIN", "192.168.0.9:1", "shared", "other/a", true, true},
+		{"unparseable address matches no network rule", "ALICE", "garbage", "shared", "logs/a", false, false},
+
+		{"closed bucket", "ALICE", "1.2.3.4:1", "closed", "nightly/a", false, false},
+		{"allow rule on a closed bucket", "BACKUP", "1.2.3.4:1", "closed", "nightly/a", false, true},
+		{"allow rule on a closed bucket can't write", "BACKUP", "1.2.3.4:1", "closed", "nightly/a", true, false},
+		{"allow rule outside its prefix", "BACKUP", "1.2.3.4:1", "closed", "weekly/a", false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := p.Allowed(c.identity, c.addr, c.bucket, c.key, c.write); got != c.want {
+				t.Fatalf("Allowed(%q, %q, %s, %s, write %v) is %v, expected %v", c.identity, c.addr, c.bucket, c.key,
+					c.write, got, c.want)
+			}
+		})
+	}
+}
+
+func TestNewRejects(t *testing.T) {
+	cases := []struct {
+		name     string
+		policies []loadArgs.BucketPolicy
+	}{
+		{"no name", []loadArgs.BucketPolicy{{Access: ReadOnly}}},
+		{"unknown access", []loadArgs.BucketPolicy{{Name: "b", Access: "write-only"}}},
+		{"unknown rule access", []loadArgs.BucketPolicy{{Name: "b", Rules: []loadArgs.PolicyRule{{Access: "all"}}}}},
+		{"bad cidr", []loadArgs.BucketPolicy{{Name: "b", Rules: []loadArgs.PolicyRule{{CIDRs: []string{"10.0.0.0/33"}}}}}},
+	}
+	for _, c := range cases {
+		if _, err := New(c.policies); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package queues
+
+import (
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//blobDir holds the content addressed files in each cache directory when Dedup is on.  Like
+//metaDir it starts with a '.' so no bucket can collide with it
+const blobDir = ".blobs"
+
+//blob is content stored once under its SHA-256 and shared by every node with that content.
+//Its fields are guarded by the queue's spaceMutex
+type blob struct {
+	name    string //the checksum, followed by the encoding if it's compressed
+	path    string
+	dir     *cacheDir
+	size    int64
+	refs    int      //nodes pointing at it
+	pending int      //Stored but not yet Added or Discarded
+	memRefs int      //nodes pointing at it that are in the memory tier
+	pinRefs int      //nodes pointing at it that are pinned
+	mem     *MemFile //shared by those nodes
+}
+
+//Store moves a complete TempFile of an object into the cache and returns the file name to Add
+//it under.  Without Dedup that's localFname.  With it the content goes to a blob named by
+//checksum in the same cache directory, or the temp file is dropped if that content is already
+//cached with the same encoding.  A file that isn't Added must be given back with Discard
+func (lru *Queue) Store(file *os.File, bucket string, fkey string, localFname string, checksum string, encoding string, sync bool) (string, error) {
+	if lru.args.Dedup == false || checksum == "" {
+		return localFname, lru.commit(file, bucket, fkey, localFname, sync)
+	}
+	name := checksum
+	if encoding != "" {
+		name += "." + encoding
+	}
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	if b, ok := lru.blobs[name]; ok {
+		if b.dir.healthy == false {
+			//the copy is on a failed disk, keep this one outside the blob store
+			return localFname, lru.commit(file, bucket, fkey, localFname, sync)
+		}
+		os.Remove(file.Name())
+		b.pending++
+		return b.path, nil
+	}
+
+	d := lru.dirOf(localFname)
+	if d == nil {
+		return "", ErrNoDir
+	}
+	path := d.path + blobDir + "/" + checksum[:2] + "/" + name
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := Commit(file, path, sync); err != nil {
+		return "", err
+	}
+	lru.blobs[name] = &blob{name: name, path: path, dir: d, pending: 1}
+	return path, nil
+}
+
+//commit renames a plain cache file into place under its key's shard lock, and counts it
+//pending until it's Added or Discarded.  removeFiles holds the same lock, so dropping an older
+//copy of the key can't delete it
+func (lru *Queue) commit(file *os.File, bucket string, fkey string, localFname string, sync bool) error {
+	if sync == true {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	s := lru.shardFor(bucket, fkey)
+	s.mutex.Lock()
+	if err := os.Rename(file.Name(), localFname); err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	s.pending[localFname]++
+	s.mutex.Unlock()
+	if sync == true {
+		return syncDir(localFname)
+	}
+	return nil
+}
+
+//Discard gives back a file Store returned for an object that could not be Added.  A plain
+//file replaced the object's older copy, so a node still queued for that copy is dropped too
+func (lru *Queue) Discard(bucket string, fkey string, localFname string) {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	if b := lru.blobAt(localFname); b != nil {
+		b.pending--
+		lru.dropBlob(b)
+		return
+	}
+	s := lru.shardFor(bucket, fkey)
+	s.mutex.Lock()
+	if s.pending[localFname]--; s.pending[localFname] <= 0 {
+		delete(s.pending, localFname)
+	}
+	node, queued := s.index[bucket+"/"+fkey]
+	if queued == true && node.LocalFname == localFname {
+		s.unlink(node)
+		removeMetadata(node.dir, bucket, fkey)
+	} else {
+		queued = false
+	}
+	if s.pending[localFname] == 0 {
+		os.Remove(localFname)
+	}
+	s.mutex.Unlock()
+	if queued == true {
+		lru.release(node)
+	}
+}
+
+//blobAt is the blob stored at path, if any.  The caller holds spaceMutex
+func (lru *Queue) blobAt(path string) *blob {
+	if lru.args.Dedup == false {
+		return nil
+	}
+	if b, ok := lru.blobs[filepath.Base(path)]; ok && b.path == path {
+		return b
+	}
+	return nil
+}
+
+//dropBlob deletes a blob nothing refers to any more.  One in a failed directory is only
+//forgotten, like dropDir leaves the files there alone.  The caller holds spaceMutex
+func (lru *Queue) dropBlob(b *blob) {
+	if b.refs > 0 || b.pending > 0 {
+		return
+	}
+	if b.dir.healthy == true {
+		os.Remove(b.path)
+	}
+	delete(lru.blobs, b.name)
+	log.Debugln("Dropped blob", b.path)
+}
+
+//addDisk and dropDisk count a node's space in its cache directory, once per blob with Dedup.
+//The caller holds spaceMutex
+func (lru *Queue) addDisk(n *Node) {
+	n.dir.files++
+	if n.Pinned == true {
+		addPinned(n)
+	}
+	if n.rule != nil {
+		n.rule.files++
+		n.rule.disk += n.size
+	}
+	if n.blob != nil {
+		n.blob.refs++
+		if n.blob.refs > 1 {
+			return
+		}
+		n.blob.size = n.size
+	}
+	n.dir.used += n.size
+}
+
+func (lru *Queue) dropDisk(n *Node) {
+	n.dir.files--
+	if n.Pinned == true {
+		dropPinned(n)
+	}
+	if n.rule != nil {
+		n.rule.files--
+		n.rule.disk -= n.size
+	}
+	if n.blob != nil {
+		n.blob.refs--
+		if n.blob.refs > 0 {
+			return
+		}
+		lru.dropBlob(n.blob)
+	}
+	n.dir.used -= n.size
+}
+
+//pinnedAdds is what pinning n adds to its directory's pinned bytes, nothing if another node
+//already pins its blob.  The caller holds spaceMutex
+func pinnedAdds(n *Node) int64 {
+	if n.blob != nil && n.blob.pinRefs > 0 {
+		return 0
+	}
+	return n.size
+}
+
+//addPinned and dropPinned count a pinned node's bytes, once per blob.  The caller holds
+//spaceMutex
+func addPinned(n *Node) {
+	n.dir.pinned += pinnedAdds(n)
+	if n.blob != nil {
+		n.blob.pinRefs++
+	}
+}
+
+func dropPinned(n *Node) {
+	if n.blob != nil {
+		n.blob.pinRefs--
+	}
+	n.dir.pinned -= pinnedAdds(n)
+}
+
+//addMem and dropMem count a node's memory, once per blob with Dedup.  The nodes of a blob
+//share one MemFile.  The caller holds spaceMutex
+func (lru *Queue) addMem(n *Node) {
+	if n.rule != nil {
+		n.rule.mem += n.size
+	}
+	if n.blob != nil {
+		n.blob.memRefs++
+		if n.blob.memRefs > 1 {
+			return
+		}
+		n.blob.mem = n.MemFile
+	}
+	lru.currMem += n.size
+}
+
+func (lru *Queue) dropMem(n *Node) {
+	if n.rule != nil {
+		n.rule.mem -= n.size
+	}
+	if n.blob != nil {
+		n.blob.memRefs--
+		if n.blob.memRefs > 0 {
+			return
+		}
+		n.blob.mem = nil
+	}
+	lru.currMem -= n.size
+}
+
+//sharedMem is the content of a node's blob if another node already has it in memory.  The
+//caller holds spaceMutex
+func sharedMem(n *Node) *MemFile {
+	if n.blob == nil {
+		return nil
+	}
+	return n.blob.mem
+}
+
+//dedupSaved is the disk space Dedup saves, the size of every extra reference to a blob.  The
+//caller holds spaceMutex
+func (lru *Queue) dedupSaved() int64 {
+	var saved int64
+	for _, b := range lru.blobs {
+		if b.refs > 1 {
+			saved += int64(b.refs-1) * b.size
+		}
+	}
+	return saved
+}
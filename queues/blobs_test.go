@@ -0,0 +1,118 @@
+package queues
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBlobRefs(t *testing.T) {
+	lru := newTestQueue(t, map[string]interface{}{"Dedup": "True", "MemCap": "4KiB", "MaxMemFileSize": "2KiB",
+		"PromoteAfter": 0})
+	defer os.RemoveAll(lru.args.LocalPath)
+	shared := content(1000)
+	if _, err := cache(lru, "a", shared, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache(lru, "b", shared, false); err != nil {
+		t.Fatal(err)
+	}
+	b := lru.Peek("a", "bkt").blob
+	if b == nil || lru.Peek("b", "bkt").blob != b {
+		t.Fatal("a and b don't share a blob")
+	}
+	expect := func(what string, refs int, memRefs int, pending int) {
+		lru.spaceMutex.Lock()
+		defer lru.spaceMutex.Unlock()
+		if b.refs != refs || b.memRefs != memRefs || b.pending != pending {
+			t.Fatalf("%s: blob has %d refs, %d in memory and %d pending, expected %d, %d and %d", what, b.refs,
+				b.memRefs, b.pending, refs, memRefs, pending)
+		}
+	}
+	expect("shared", 2, 1, 0)
+	if stats := lru.Stats(); stats.DiskUsed != 1000 || stats.MemUsed != 1000 || stats.DedupSaved != 1000 {
+		t.Fatalf("shared content counted as %d on disk and %d in memory, saving %d", stats.DiskUsed, stats.MemUsed,
+			stats.DedupSaved)
+	}
+	checkQueue(t, lru)
+
+	//overwriting a leaves b the blob's only reference, and nothing of it in memory
+	if _, err := cache(lru, "a", content(800), false); err != nil {
+		t.Fatal(err)
+	}
+	expect("overwritten", 1, 0, 0)
+	if stats := lru.Stats(); stats.DiskUsed != 1800 || stats.MemUsed != 0 || stats.DedupSaved != 0 {
+		t.Fatalf("after overwriting, %d used on disk and %d in memory, saving %d", stats.DiskUsed, stats.MemUsed,
+			stats.DedupSaved)
+	}
+	checkQueue(t, lru)
+
+	//the same content stored again is pending until it's given back
+	path, _, _, err := store(lru, "c", shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != b.path {
+		t.Fatalf("stored the same content at %s rather than in its blob %s", path, b.path)
+	}
+	expect("stored", 1, 0, 1)
+	lru.Discard("bkt", "c", path)
+	expect("discarded", 1, 0, 0)
+	if _, err = os.Stat(b.path); err != nil {
+		t.Fatal("discarding a copy removed the blob b still uses")
+	}
+
+	//new content nothing refers to is dropped with its Discard
+	path, _, _, err = store(lru, "c", content(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lru.Discard("bkt", "c", path)
+	if _, err = os.Stat(path); os.IsNotExist(err) == false {
+		t.Fatal("a discarded blob was kept")
+	}
+
+	lru.Remove("b", "bkt")
+	if _, err = os.Stat(b.path); os.IsNotExist(err) == false {
+		t.Fatal("the blob outlived its last reference")
+	}
+	lru.Remove("a", "bkt")
+	checkQueue(t, lru)
+	if stats := lru.Stats(); stats.Blobs != 0 || stats.DiskUsed != 0 || stats.Files != 0 {
+		t.Fatalf("nothing cached, but stats are %+v", stats)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	lru := newTestQueue(t, map[string]interface{}{})
+	defer os.RemoveAll(lru.args.LocalPath)
+	node, err := cache(lru, "a", content(1000), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a new copy replaces the file of the queued one, which goes with it
+	path, _, _, err := store(lru, "a", content(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != node.LocalFname {
+		t.Fatalf("the new copy went to %s, not %s", path, node.LocalFname)
+	}
+	lru.Discard("bkt", "a", path)
+	if lru.Peek("a", "bkt") != nil {
+		t.Fatal("a is still queued for a discarded file")
+	}
+	if _, err = os.Stat(path); os.IsNotExist(err) == false {
+		t.Fatal("the discarded file was kept")
+	}
+	s := lru.shardFor("bkt", "a")
+	s.mutex.Lock()
+	pending := len(s.pending)
+	s.mutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d files still pending", pending)
+	}
+	checkQueue(t, lru)
+	if stats := lru.Stats(); stats.Files != 0 || stats.DiskUsed != 0 {
+		t.Fatalf("nothing cached, but stats are %+v", stats)
+	}
+}
@@ -0,0 +1,164 @@
+package queues
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//Encoding is the compression the Compress setting gives an object by its content type, ""
+//for none.  Objects the client already encoded are left alone
+func (lru *Queue) Encoding(meta *Metadata) string {
+	if len(lru.args.Compress) == 0 || meta == nil || meta.ContentEncoding != "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(meta.ContentType)
+	if err != nil {
+		return ""
+	}
+	if encoding, ok := lru.args.Compress[mediaType]; ok {
+		return encoding
+	}
+	return lru.args.Compress[mediaType[:strings.Index(mediaType, "/")+1]+"*"]
+}
+
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, errors.New("unknown compression " + encoding)
+}
+
+//Decoder reads stored content as clients see it, decompressing on the fly.  It is an
+//io.ReadSeeker as ServeContent needs for Range requests: a seek is free, and the next read
+//decompresses up to the new position, from the start again if it's behind
+type Decoder struct {
+	src      io.ReadSeeker
+	encoding string
+	length   int64
+	gz       *gzip.Reader
+	zs       *zstd.Decoder
+	r        io.Reader //the decompressed stream, nil until the first read
+	pos      int64     //where r is
+	offset   int64     //where the next read is from
+}
+
+//Decode wraps content stored with encoding, whose decompressed length is length.  Content
+//stored as is is read straight through.  Close the Decoder when done, which closes src too
+func Decode(src io.ReadSeeker, encoding string, length int64) *Decoder {
+	return &Decoder{src: src, encoding: encoding, length: length}
+}
+
+func (d *Decoder) Read(p []byte) (int, error) {
+	if d.encoding == "" {
+		return d.src.Read(p)
+	}
+	if d.r == nil || d.offset < d.pos {
+		if err := d.reset(); err != nil {
+			return 0, err
+		}
+	}
+	if d.pos < d.offset {
+		skipped, err := io.CopyN(ioutil.Discard, d.r, d.offset-d.pos)
+		d.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := d.r.Read(p)
+	d.pos += int64(n)
+	d.offset = d.pos
+	return n, err
+}
+
+//reset starts decompressing from the beginning of the content
+func (d *Decoder) reset() error {
+	if _, err := d.src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var err error
+	switch {
+	case d.encoding == "gzip" && d.gz != nil:
+		err = d.gz.Reset(d.src)
+	case d.encoding == "gzip":
+		d.gz, err = gzip.NewReader(d.src)
+		d.r = d.gz
+	case d.encoding == "zstd" && d.zs != nil:
+		err = d.zs.Reset(d.src)
+	case d.encoding == "zstd":
+		d.zs, err = zstd.NewReader(d.src, zstd.WithDecoderConcurrency(1))
+		d.r = d.zs
+	default:
+		err = errors.New("unknown compression " + d.encoding)
+	}
+	if err != nil {
+		d.r = nil
+	}
+	d.pos = 0
+	return err
+}
+
+func (d *Decoder) Seek(offset int64, whence int) (int64, error) {
+	if d.encoding == "" {
+		return d.src.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.length
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the content")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+//Stored reads the content as stored, still compressed.  Don't mix it with reading the Decoder
+func (d *Decoder) Stored() io.ReadSeeker {
+	return d.src
+}
+
+//Close releases the decompressor, and src if it's an io.Closer
+func (d *Decoder) Close() error {
+	if d.zs != nil {
+		d.zs.Close()
+	}
+	if closer, ok := d.src.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+//Open reads a node's content as clients see it, from memory if it's there.  Close it when done
+func (lru *Queue) Open(n *Node) (*Decoder, error) {
+	if n.Inmem == true {
+		//a reader per request, the cached content is shared
+		return Decode(n.MemFile.Reader(), n.Encoding, n.Length), nil
+	}
+	return lru.openDisk(n)
+}
+
+//openDisk reads a node's content from its cache file, even if it's in memory too
+func (lru *Queue) openDisk(n *Node) (*Decoder, error) {
+	file, err := os.Open(n.LocalFname)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := lru.Unseal(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return Decode(stored, n.Encoding, n.Length), nil
+}
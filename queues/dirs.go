@@ -0,0 +1,287 @@
+package queues
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"os"
+	"s3envoy/loadArgs"
+	"s3envoy/metrics"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//ErrNoDir is returned when every cache directory has failed
+var ErrNoDir = errors.New("no healthy cache directory")
+
+//ErrNoSpace is returned by Place when the filesystem of every healthy cache directory is
+//past DiskCriticalWatermark
+var ErrNoSpace = errors.New("cache disks are critically full")
+
+//cacheDir is one of the directories objects are cached in, usually a disk of its own.  Its
+//fields other than path are guarded by the queue's spaceMutex
+type cacheDir struct {
+	path     string
+	capacity int64
+	used     int64
+	pinned   int64 //bytes of pinned objects, which can't be evicted
+	files    int
+	healthy  bool
+	fsUsed   int  //percent of the filesystem in use at the last CheckSpace
+	critical bool //past DiskCriticalWatermark, no new objects
+}
+
+//DirStats is the occupancy and health of a cache directory
+type DirStats struct {
+	Path     string
+	Capacity int64
+	Used     int64
+	Pinned   int64 //bytes of pinned objects
+	Files    int
+	Healthy  bool
+	FSUsed   int //percent of the filesystem in use, by anything
+	Critical bool
+}
+
+//newDirs sets up the configured cache directories, or LocalPath alone
+func newDirs(args *loadArgs.Args) []*cacheDir {
+	if len(args.CacheDirs) == 0 {
+		return []*cacheDir{{path: args.LocalPath, capacity: args.DiskCap, healthy: true}}
+	}
+	var dirs []*cacheDir
+	for _, dir := range args.CacheDirs {
+		dirs = append(dirs, &cacheDir{path: dir.Path, capacity: dir.Capacity, healthy: true})
+	}
+	return dirs
+}
+
+//Place picks the cache directory for an object and returns the file name it should be
+//written to.  An object already cached stays where it is, otherwise it goes by the
+//Placement setting.  It fails with ErrNoDir if every directory has failed, ErrNoSpace if the
+//ones left are critically full
+func (lru *Queue) Place(bucket string, fkey string, size int64) (string, error) {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	if node := lru.Peek(fkey, bucket); node != nil && node.dir.healthy == true && node.dir.critical == false {
+		//not node.LocalFname, with Dedup that's a blob other objects may share
+		return node.dir.path + bucket + "/" + fkey, nil
+	}
+
+	var best *cacheDir
+	var bestScore float64
+	full := false
+	for _, d := range lru.dirs {
+		if d.healthy == false {
+			continue
+		}
+		if d.critical == true {
+			full = true
+			continue
+		}
+		var score float64
+		if lru.args.Placement == "free" {
+			score = float64(d.capacity - d.used)
+		} else {
+			score = rendezvous(d, bucket+"/"+fkey)
+		}
+		//a directory too small for the object is only used if there's nothing else
+		if d.capacity < size {
+			score -= math.MaxFloat64 / 2
+		}
+		if best == nil || score > bestScore {
+			best = d
+			bestScore = score
+		}
+	}
+	if best == nil && full == true {
+		return "", ErrNoSpace
+	} else if best == nil {
+		return "", ErrNoDir
+	}
+	return best.path + bucket + "/" + fkey, nil
+}
+
+//Fits is true if an object of size could be cached at all: some usable directory has room
+//for it once everything there that isn't pinned is evicted
+func (lru *Queue) Fits(size int64) bool {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	for _, d := range lru.dirs {
+		if d.healthy == true && d.critical == false && d.capacity-d.pinned >= size {
+			return true
+		}
+	}
+	return false
+}
+
+//rendezvous is the weighted highest random weight score of a key for a directory.  Each key
+//goes to the directory scoring highest, in proportion to capacity, and only the keys of a
+//directory that fails or comes back move
+func rendezvous(d *cacheDir, key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(d.path))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	//FNV's high bits hardly change with the last bytes of a key, mix them in (splitmix64)
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return float64(d.capacity) / -math.Log(u)
+}
+
+//dirOf is the cache directory holding a local file, nil if it's in none of them
+func (lru *Queue) dirOf(localFname string) *cacheDir {
+	for _, d := range lru.dirs {
+		if len(localFname) > len(d.path) && localFname[:len(d.path)] == d.path {
+			return d
+		}
+	}
+	return nil
+}
+
+//CheckDirs probes every cache directory by writing, syncing and reading back a small file.
+//A directory that fails has its objects dropped from the queue so the node keeps serving
+//from the others, and is used again once a probe succeeds
+func (lru *Queue) CheckDirs() {
+	for _, d := range lru.dirs {
+		err := probe(d.path)
+		lru.spaceMutex.Lock()
+		if err != nil && d.healthy == true {
+			d.healthy = false
+			dropped := lru.dropDir(d)
+			log.Errorln("Cache dir failed, dropped", dropped, "objects", d.path, err)
+		} else if err == nil && d.healthy == false {
+			d.healthy = true
+			log.Infoln("Cache dir is usable again", d.path)
+		}
+		lru.updateMetrics()
+		lru.spaceMutex.Unlock()
+	}
+}
+
+func probe(path string) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(path, ".probe")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	payload := []byte("s3envoy cache dir probe")
+	_, err = file.Write(payload)
+	if err == nil {
+		err = file.Sync()
+	}
+	if errC := file.Close(); err == nil {
+		err = errC
+	}
+	if err != nil {
+		return err
+	}
+	read, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(read, payload) == false {
+		return errors.New("probe file read back wrong")
+	}
+	return nil
+}
+
+//CheckSpace compares how full the filesystem of each cache directory is with the watermarks.
+//Past DiskHighWatermark objects are evicted until it's back under DiskLowWatermark, which
+//also reclaims space lost to other tenants of the disk.  Past DiskCriticalWatermark the
+//directory takes no new objects
+func (lru *Queue) CheckSpace() {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	for _, d := range lru.dirs {
+		if d.healthy == false {
+			continue
+		}
+		used, usedBytes, total, err := fsUsage(d.path)
+		if err != nil {
+			log.Warnln("Could not check free space of", d.path, err)
+			continue
+		}
+		if used >= lru.args.DiskHighWatermark {
+			log.Warnln("Cache dir filesystem is", used, "percent full, evicting", d.path)
+			//what has to go is worked out once, the objects evicted say what they freed
+			target := usedBytes - total*int64(lru.args.DiskLowWatermark)/100
+			var freed int64
+			for freed < target {
+				before := d.used
+				if lru.evict(d) == false {
+					break
+				}
+				freed += before - d.used
+			}
+			used = percent(usedBytes-freed, total)
+			if used > lru.args.DiskLowWatermark {
+				log.Warnln("Evicting what's cached can't bring", d.path, "under", lru.args.DiskLowWatermark, "percent, it's at", used)
+			}
+		}
+		critical := used >= lru.args.DiskCriticalWatermark
+		if critical == true && d.critical == false {
+			log.Errorln("Cache dir filesystem is critically full, taking no new objects", d.path, used)
+		} else if critical == false && d.critical == true {
+			log.Infoln("Cache dir filesystem has room again", d.path, used)
+		}
+		d.critical = critical
+		d.fsUsed = used
+	}
+	lru.updateMetrics()
+}
+
+//dropDir forgets every object in a failed directory, pinned ones too.  Its files are left
+//alone, the disk can't be trusted.  The caller holds spaceMutex
+func (lru *Queue) dropDir(d *cacheDir) int {
+	dropped := 0
+	for _, s := range lru.shards {
+		var nodes []*Node
+		s.mutex.Lock()
+		for _, node := range s.index {
+			if node.dir == d {
+				s.unlink(node)
+				nodes = append(nodes, node)
+			}
+		}
+		s.mutex.Unlock()
+		for _, node := range nodes {
+			lru.release(node)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+//disk is the space used in and the capacity of the healthy cache directories
+func (lru *Queue) disk() (int64, int64) {
+	var used, capacity int64
+	for _, d := range lru.dirs {
+		used += d.used
+		if d.healthy == true {
+			capacity += d.capacity
+		}
+	}
+	return used, capacity
+}
+
+func (lru *Queue) dirMetrics() {
+	for _, d := range lru.dirs {
+		up := 0.0
+		if d.healthy == true {
+			up = 1
+		}
+		metrics.CacheDirUp.WithLabelValues(d.path).Set(up)
+		metrics.CacheDirBytes.WithLabelValues(d.path).Set(float64(d.used))
+		metrics.CacheDirFSUsed.WithLabelValues(d.path).Set(float64(d.fsUsed) / 100)
+	}
+}
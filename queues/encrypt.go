@@ -0,0 +1,412 @@
+package queues
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//Cache files are encrypted with AES-256-GCM when EncryptionKeys are set.  Each file has its
+//own random data key, kept in the file's header wrapped by a master key, and its content is
+//sealed in chunks so a Range read only decrypts the chunks it covers.  The header is
+//
+//	magic | master key id | wrap nonce | wrapped data key | chunk nonce prefix | chunk size
+//
+//and each chunk is sealed with the nonce prefix and its index, its index and whether it's the
+//last one as additional data, so chunks can't be reordered or the file cut short unnoticed
+const (
+	sealMagic     = "S3EC\x01"
+	keyIDSize     = 8
+	wrapNonceSize = 12
+	wrappedSize   = 32 + 16
+	prefixSize    = 8
+	headerSize    = len(sealMagic) + keyIDSize + wrapNonceSize + wrappedSize + prefixSize + 4
+	//wrapStart and wrapEnd delimit the part of the header a key rotation rewrites
+	wrapStart = len(sealMagic)
+	wrapEnd   = wrapStart + keyIDSize + wrapNonceSize + wrappedSize
+	chunkSize = 64 << 10
+)
+
+//ErrUnknownKey is returned for a file sealed with a master key that's no longer configured
+var ErrUnknownKey = errors.New("cache file is encrypted with an unknown master key")
+
+//ErrNotSealed is returned by Unseal for a file that isn't encrypted although EncryptionKeys are
+//set.  Every file is sealed before it's cached, so one that isn't was replaced or truncated
+var ErrNotSealed = errors.New("cache file is not encrypted")
+
+func keyID(master []byte) []byte {
+	sum := sha256.Sum256(master)
+	return sum[:keyIDSize]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//wrap seals a data key with a master key into the rotatable part of a header
+func wrap(master []byte, dataKey []byte) ([]byte, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	part := make([]byte, keyIDSize+wrapNonceSize, wrapEnd-wrapStart)
+	copy(part, keyID(master))
+	if _, err = rand.Read(part[keyIDSize:]); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(part, part[keyIDSize:], dataKey, part[:keyIDSize]), nil
+}
+
+//unwrap opens the data key in a header with whichever master key sealed it
+func unwrap(masters [][]byte, header []byte) ([]byte, error) {
+	part := header[wrapStart:wrapEnd]
+	for _, master := range masters {
+		if bytes.Equal(keyID(master), part[:keyIDSize]) == false {
+			continue
+		}
+		gcm, err := newGCM(master)
+		if err != nil {
+			return nil, err
+		}
+		nonce := part[keyIDSize : keyIDSize+wrapNonceSize]
+		return gcm.Open(nil, nonce, part[keyIDSize+wrapNonceSize:], part[:keyIDSize])
+	}
+	return nil, ErrUnknownKey
+}
+
+func chunkNonce(prefix []byte, index int64) []byte {
+	nonce := make([]byte, prefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], uint32(index))
+	return nonce
+}
+
+func chunkAD(index int64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, uint64(index))
+	if last == true {
+		ad[8] = 1
+	}
+	return ad
+}
+
+//sealer encrypts content as it's written, a chunk at a time.  A full chunk is held back until
+//more content comes, as the last one is sealed differently, so only Close writes it
+type sealer struct {
+	out    *bufio.Writer
+	gcm    cipher.AEAD
+	prefix []byte
+	plain  []byte //the chunk being filled
+	box    []byte
+	index  int64
+}
+
+//newSealer writes the header of a file sealed with master to w, and returns the writer for
+//its content
+func newSealer(w io.Writer, master []byte) (*sealer, error) {
+	dataKey := make([]byte, 32)
+	header := make([]byte, headerSize)
+	copy(header, sealMagic)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(header[wrapEnd : wrapEnd+prefixSize]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(header[wrapEnd+prefixSize:], chunkSize)
+	part, err := wrap(master, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	copy(header[wrapStart:], part)
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	s := &sealer{out: bufio.NewWriter(w), gcm: gcm, prefix: header[wrapEnd : wrapEnd+prefixSize],
+		plain: make([]byte, 0, chunkSize)}
+	_, err = s.out.Write(header)
+	return s, err
+}
+
+func (s *sealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.plain) == chunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.plain[len(s.plain):chunkSize], p)
+		s.plain = s.plain[:len(s.plain)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealer) seal(last bool) error {
+	s.box = s.gcm.Seal(s.box[:0], chunkNonce(s.prefix, s.index), s.plain, chunkAD(s.index, last))
+	s.index++
+	s.plain = s.plain[:0]
+	_, err := s.out.Write(s.box)
+	return err
+}
+
+//Close seals the last chunk, which an empty file still has one of so a sealed file is never
+//empty past its header
+func (s *sealer) Close() error {
+	if err := s.seal(true); err != nil {
+		return err
+	}
+	return s.out.Flush()
+}
+
+//Unseal reads a cache file as it was before it was sealed.  Without EncryptionKeys files are read as
+//they are, with them a file that isn't sealed fails with ErrNotSealed
+func (lru *Queue) Unseal(src io.ReadSeeker) (io.ReadSeeker, error) {
+	masters := lru.args.MasterKeys()
+	if len(masters) == 0 {
+		return src, nil
+	}
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if n < headerSize || bytes.Equal(header[:len(sealMagic)], []byte(sealMagic)) == false {
+		return nil, ErrNotSealed
+	}
+	dataKey, err := unwrap(masters, header)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	body := size - int64(headerSize)
+	box := int64(chunkSize + gcm.Overhead())
+	chunks := (body + box - 1) / box
+	if chunks == 0 || binary.BigEndian.Uint32(header[wrapEnd+prefixSize:]) != chunkSize {
+		return nil, errors.New("cache file has a damaged encryption header")
+	}
+	return &unsealer{src: src, gcm: gcm, prefix: header[wrapEnd : wrapEnd+prefixSize],
+		chunks: chunks, length: body - chunks*int64(gcm.Overhead()), chunk: -1}, nil
+}
+
+//sealedFor is true if a cache file can be read with masters: it's sealed with one of them, or
+//there are none and it isn't sealed
+func sealedFor(path string, masters [][]byte) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, headerSize)
+	n, _ := io.ReadFull(file, header)
+	sealed := n == headerSize && bytes.Equal(header[:len(sealMagic)], []byte(sealMagic)) == true
+	if len(masters) == 0 || sealed == false {
+		return len(masters) == 0 && sealed == false
+	}
+	for _, master := range masters {
+		if bytes.Equal(keyID(master), header[wrapStart:wrapStart+keyIDSize]) == true {
+			return true
+		}
+	}
+	return false
+}
+
+//unsealer decrypts a sealed file a chunk at a time.  Seeking is free, only the chunks read
+//are decrypted
+type unsealer struct {
+	src    io.ReadSeeker
+	gcm    cipher.AEAD
+	prefix []byte
+	chunks int64
+	length int64  //of the plain content
+	offset int64  //in the plain content
+	chunk  int64  //index of the chunk in plain, -1 for none
+	plain  []byte //the decrypted chunk
+}
+
+func (u *unsealer) Read(p []byte) (int, error) {
+	if u.offset >= u.length {
+		return 0, io.EOF
+	}
+	index := u.offset / chunkSize
+	if index != u.chunk {
+		box := make([]byte, chunkSize+u.gcm.Overhead())
+		if index == u.chunks-1 {
+			box = box[:u.length-index*chunkSize+int64(u.gcm.Overhead())]
+		}
+		if _, err := u.src.Seek(int64(headerSize)+index*int64(chunkSize+u.gcm.Overhead()), io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(u.src, box); err != nil {
+			return 0, err
+		}
+		plain, err := u.gcm.Open(u.plain[:0], chunkNonce(u.prefix, index), box, chunkAD(index, index == u.chunks-1))
+		if err != nil {
+			u.chunk = -1
+			return 0, errors.New("cache file failed to decrypt, it's damaged or was tampered with")
+		}
+		u.plain = plain
+		u.chunk = index
+	}
+	n := copy(p, u.plain[u.offset-index*chunkSize:])
+	u.offset += int64(n)
+	return n, nil
+}
+
+func (u *unsealer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += u.offset
+	case io.SeekEnd:
+		offset += u.length
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the content")
+	}
+	u.offset = offset
+	return offset, nil
+}
+
+//Close closes the file underneath
+func (u *unsealer) Close() error {
+	if closer, ok := u.src.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+//ReadStored reads a cache file's content as the memory tier keeps it: decrypted, but still
+//compressed if it is
+func (lru *Queue) ReadStored(localFname string) ([]byte, error) {
+	file, err := os.Open(localFname)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stored, err := lru.Unseal(file)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(stored)
+}
+
+//Rewrap reseals the data key of every encrypted cache file with the current master key, the
+//first of EncryptionKeys, so older keys can be dropped once it's done.  Each file is copied
+//with the new header and renamed over the old one.  It returns how many files it changed
+func (lru *Queue) Rewrap() (int, error) {
+	masters := lru.args.MasterKeys()
+	if len(masters) == 0 {
+		return 0, nil
+	}
+	current := keyID(masters[0])
+	done := make(map[string]bool)
+	rewrapped := 0
+	var failed error
+	for _, node := range lru.Nodes() {
+		if done[node.LocalFname] == true {
+			continue
+		}
+		done[node.LocalFname] = true
+		changed, err := lru.rewrapFile(node, masters, current)
+		if os.IsNotExist(err) {
+			continue //evicted meanwhile
+		} else if err != nil {
+			log.Errorln("Could not rewrap the data key of", node.LocalFname, err)
+			failed = err
+			continue
+		}
+		if changed == true {
+			rewrapped++
+		}
+	}
+	return rewrapped, failed
+}
+
+//rewrapFile copies a node's file with its data key wrapped by the current master key and
+//renames the copy into place, so a crash or a full disk can't leave a damaged header
+func (lru *Queue) rewrapFile(node *Node, masters [][]byte, current []byte) (bool, error) {
+	path := node.LocalFname
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	header := make([]byte, headerSize)
+	if _, err = io.ReadFull(file, header); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if bytes.Equal(header[:len(sealMagic)], []byte(sealMagic)) == false || bytes.Equal(header[wrapStart:wrapStart+keyIDSize], current) == true {
+		return false, nil
+	}
+	dataKey, err := unwrap(masters, header)
+	if err != nil {
+		return false, err
+	}
+	part, err := wrap(masters[0], dataKey)
+	if err != nil {
+		return false, err
+	}
+	copy(header[wrapStart:], part)
+
+	rewrapped, err := TempFile(path)
+	if err != nil {
+		return false, err
+	}
+	defer rewrapped.Close()
+	_, err = rewrapped.Write(header)
+	if err == nil {
+		_, err = io.Copy(rewrapped, file)
+	}
+	if err == nil {
+		err = rewrapped.Sync()
+	}
+	if err != nil {
+		os.Remove(rewrapped.Name())
+		return false, err
+	}
+
+	//the file may have been replaced or evicted while it was copied.  Both happen under
+	//spaceMutex or the key's shard lock, so holding them the check and rename are one step
+	lru.spaceMutex.Lock()
+	s := lru.shardFor(node.Bucket, node.Fkey)
+	s.mutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	defer s.mutex.Unlock()
+	read, errR := file.Stat()
+	now, errN := os.Stat(path)
+	if errR != nil || errN != nil || os.SameFile(read, now) == false {
+		os.Remove(rewrapped.Name())
+		return false, nil
+	}
+	if err = Commit(rewrapped, path, false); err != nil {
+		os.Remove(rewrapped.Name())
+		return false, err
+	}
+	return true, nil
+}
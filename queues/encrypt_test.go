@@ -0,0 +1,195 @@
+package queues
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+//newSealQueue is a test queue encrypting with keys.  They can be changed through
+//lru.args.EncryptionKeys
+func newSealQueue(t *testing.T, keys ...[]byte) *Queue {
+	var encoded []string
+	for _, key := range keys {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(key))
+	}
+	return newTestQueue(t, map[string]interface{}{"EncryptionKeys": encoded})
+}
+
+//sealFile caches content under key the way a download does, and returns its file name and size
+func sealFile(t *testing.T, lru *Queue, key string, content []byte) (string, int64) {
+	localFname := lru.args.LocalPath + "bkt/" + key
+	w, err := lru.NewWriter(localFname, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	file, _, size, err := w.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err = Commit(file, localFname, false); err != nil {
+		t.Fatal(err)
+	}
+	return localFname, size
+}
+
+func content(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+	return data
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	lru := newSealQueue(t, newKey(t))
+	defer os.RemoveAll(lru.args.LocalPath)
+	for _, size := range []int{0, 1, 1000, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize - 7} {
+		plain := content(size)
+		path, stored := sealFile(t, lru, "round-trip", plain)
+		if stored <= int64(size) {
+			t.Fatalf("sealed %d bytes into %d", size, stored)
+		}
+		if raw, _ := ioutil.ReadFile(path); size >= 16 && bytes.Contains(raw, plain) {
+			t.Fatalf("%d bytes were stored in the clear", size)
+		}
+		read, err := lru.ReadStored(path)
+		if err != nil {
+			t.Fatalf("reading %d bytes: %v", size, err)
+		}
+		if bytes.Equal(read, plain) == false {
+			t.Fatalf("%d bytes read back as %d different ones", size, len(read))
+		}
+	}
+}
+
+func TestUnsealRejects(t *testing.T) {
+	key := newKey(t)
+	flip := func(offset int64) func(t *testing.T, path string) {
+		return func(t *testing.T, path string) {
+			data, _ := ioutil.ReadFile(path)
+			if offset < 0 {
+				offset += int64(len(data))
+			}
+			data[offset] ^= 1
+			ioutil.WriteFile(path, data, 0644)
+		}
+	}
+	box := int64(chunkSize + 16)
+
+	cases := []struct {
+		name   string
+		size   int
+		damage func(t *testing.T, path string)
+		keys   [][]byte //to read with, the sealing key if nil
+		err    error    //nil for any error
+	}{
+		{name: "flipped content", size: 1000, damage: flip(int64(headerSize) + 10)},
+		{name: "flipped tag", size: 1000, damage: flip(-1)},
+		{name: "flipped key id", size: 1000, damage: flip(int64(wrapStart)), err: ErrUnknownKey},
+		{name: "flipped wrapped key", size: 1000, damage: flip(int64(wrapEnd) - 1)},
+		{name: "flipped nonce prefix", size: 1000, damage: flip(int64(wrapEnd))},
+		{name: "flipped chunk size", size: 1000, damage: flip(int64(headerSize) - 1)},
+		{name: "last chunk cut off", size: 2 * chunkSize, damage: func(t *testing.T, path string) {
+			os.Truncate(path, int64(headerSize)+box)
+		}},
+		{name: "chunks swapped", size: 2 * chunkSize, damage: func(t *testing.T, path string) {
+			data, _ := ioutil.ReadFile(path)
+			first := append([]byte{}, data[headerSize:int64(headerSize)+box]...)
+			copy(data[headerSize:], data[int64(headerSize)+box:])
+			copy(data[int64(headerSize)+box:], first)
+			ioutil.WriteFile(path, data, 0644)
+		}},
+		{name: "wrong key", size: 1000, keys: [][]byte{newKey(t)}, err: ErrUnknownKey},
+		{name: "plaintext", size: 1000, err: ErrNotSealed, damage: func(t *testing.T, path string) {
+			ioutil.WriteFile(path, content(1000), 0644)
+		}},
+		{name: "shorter than a header", size: 1000, err: ErrNotSealed, damage: func(t *testing.T, path string) {
+			os.Truncate(path, int64(headerSize)-1)
+		}},
+		{name: "empty", size: 1000, err: ErrNotSealed, damage: func(t *testing.T, path string) {
+			os.Truncate(path, 0)
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lru := newSealQueue(t, key)
+			defer os.RemoveAll(lru.args.LocalPath)
+			path, _ := sealFile(t, lru, "damaged", content(c.size))
+			if c.damage != nil {
+				c.damage(t, path)
+			}
+			if c.keys != nil {
+				lru.args.EncryptionKeys = c.keys
+			}
+			_, err := lru.ReadStored(path)
+			if err == nil {
+				t.Fatal("read back without an error")
+			}
+			if c.err != nil && err != c.err {
+				t.Fatalf("expected %v, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	old, current := newKey(t), newKey(t)
+	lru := newSealQueue(t, old)
+	defer os.RemoveAll(lru.args.LocalPath)
+	files := map[string][]byte{"small": content(100), "chunked": content(2*chunkSize + 5), "empty": content(0)}
+	paths := make(map[string]string)
+	for key, plain := range files {
+		path, size := sealFile(t, lru, key, plain)
+		if _, err := lru.Add("bkt", key, path, size, false, nil, &Metadata{}, "", "", int64(len(plain))); err != nil {
+			t.Fatal(err)
+		}
+		paths[key] = path
+	}
+
+	//with the old key only, there's nothing to rewrap to
+	if rewrapped, err := lru.Rewrap(); err != nil || rewrapped != 0 {
+		t.Fatalf("rewrapped %d files with an unchanged key, error %v", rewrapped, err)
+	}
+	before, _ := os.Stat(paths["small"])
+	lru.args.EncryptionKeys = [][]byte{current, old}
+	if rewrapped, err := lru.Rewrap(); err != nil || rewrapped != len(files) {
+		t.Fatalf("rewrapped %d of %d files, error %v", rewrapped, len(files), err)
+	}
+	if rewrapped, err := lru.Rewrap(); err != nil || rewrapped != 0 {
+		t.Fatalf("rewrapped %d files a second time, error %v", rewrapped, err)
+	}
+	//replaced, not rewritten in place
+	if after, _ := os.Stat(paths["small"]); os.SameFile(before, after) == true {
+		t.Fatal("rewrapped the file in place")
+	}
+
+	//the old key can go now
+	lru.args.EncryptionKeys = [][]byte{current}
+	for key, plain := range files {
+		read, err := lru.ReadStored(paths[key])
+		if err != nil {
+			t.Fatalf("reading %s after the rotation: %v", key, err)
+		}
+		if bytes.Equal(read, plain) == false {
+			t.Fatalf("%s changed in the rotation", key)
+		}
+	}
+	lru.args.EncryptionKeys = [][]byte{old}
+	if _, err := lru.ReadStored(paths["small"]); err != ErrUnknownKey {
+		t.Fatalf("expected the old key to be unusable, got %v", err)
+	}
+}
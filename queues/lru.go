@@ -1,180 +1,726 @@
 package queues
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"io"
 	"os"
 	"s3envoy/hashes"
 	"s3envoy/loadArgs"
+	"s3envoy/metrics"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-//Node struct for each local file node
+//Node struct for each local file node.  Every cached object is on disk, small or hot ones
+//are in memory as well.  Everything but Pinned is fixed once the node is queued; an
+//overwritten object, or one moving between tiers, gets a new Node
 type Node struct {
 	dirty      bool //  dirty or clean
 	Bucket     string
 	LocalFname string
 	Fkey       string
-	size       int64
-	Inmem      bool     //is file small enough to be in memory
-	MemFile    *MemFile //only if file is in memory
+	size       int64     //bytes stored, compressed if Encoding is set
+	Length     int64     //bytes of content clients see
+	Encoding   string    //compression of the stored content, see compress.go
+	Inmem      bool      //is the file in the memory tier too
+	MemFile    *MemFile  //only if file is in memory
+	Meta       *Metadata //object metadata as S3 returns it
+	Checksum   string    //hex SHA-256 of the content, before compression
+	Pinned     bool      //pinned objects are never evicted, read it through the Queue
+	rule       *rule     //the retention rule the object falls under, nil for none
+	Added      time.Time //when the object entered the cache
 	ModTime    time.Time
+	lastUsed   time.Time
+	dir        *cacheDir //the cache directory LocalFname is in
+	blob       *blob     //the shared content with Dedup, LocalFname is its path
+	hits       int       //reads from disk since the node was queued, towards promotion
+	promoting  bool      //a promotion into memory is under way
 	prev       *Node
 	next       *Node
 }
 
-//Queue struct for local files
+//ErrNoRoom is returned by Add when an object can't fit even after evicting everything
+//that isn't pinned.  The caller still owns the local file
+var ErrNoRoom = errors.New("not enough cache capacity left")
+
+//numShards the queue's keys are spread over.  Each shard has its own lock and LRU list
+const numShards = 16
+
+//Queue struct for local files.  Objects are kept in two tiers: all of them on disk, counted
+//against the capacity of the cache directory they're in, and the small or frequently read ones in memory as well, counted against
+//memCap.  Running out of memory demotes objects to disk only, running out of disk evicts
+//them from the cache.  It is safe for concurrent use: lookups only lock the
+//shard the key hashes to, while space accounting and eviction are serialized by spaceMutex.
+//spaceMutex is always taken before a shard's lock, never while holding one
 type Queue struct {
-	totalFiles int   // number of files allowed to be held locally
-	currFiles  int   //number of current files help locally
-	diskCap    int64 //total storage size in bytes
-	currDisk   int64 //current storage size in bytes
-	memCap     int64 //total storage size in bytes
-	currMem    int64 //current storage size in bytes
-	head       *Node
-	tail       *Node
+	totalFiles int              // number of files allowed to be held locally
+	currFiles  int              //number of current files help locally
+	dirs       []*cacheDir      //disk storage, see dirs.go
+	blobs      map[string]*blob //content by checksum with Dedup, see blobs.go
+	rules      []*rule          //retention rules, most specific first, see retention.go
+	priorities []int            //the rules' priorities, lowest first, the order of eviction
+	memCap     int64            //total storage size in bytes
+	currMem    int64            //current storage size in bytes
+	draining   bool             //objects are no longer advertised to peers
+	spaceMutex sync.Mutex
+	shards     [numShards]*shard
 	args       *loadArgs.Args //program arguments
 	Gh         *hashes.Gh
 }
 
+//Stats is a summary of what the queue holds
+type Stats struct {
+	Files       int
+	Pinned      int
+	PinnedBytes int64
+	MemFiles    int
+	MemUsed     int64
+	MemCap      int64
+	DiskUsed    int64
+	DiskCap     int64
+	Dirs        []DirStats
+	Blobs       int   //distinct contents with Dedup
+	DedupSaved  int64 //bytes not stored twice thanks to Dedup
+	Rules       []RuleStats
+	Draining    bool
+}
+
 //InitializeQueue global LRU
 func InitializeQueue(args *loadArgs.Args) *Queue {
-	new := &Queue{totalFiles: args.TotalFiles, currFiles: 0, diskCap: args.DiskCap, currDisk: 0,
-		memCap: args.MemCap, currMem: 0, head: nil, tail: nil,
-		args: args}
+	new := &Queue{totalFiles: args.TotalFiles, currFiles: 0, dirs: newDirs(args), blobs: make(map[string]*blob),
+		memCap: args.MemCap, currMem: 0, args: args}
+	new.rules = newRules(args)
+	new.priorities = priorities(new.rules)
+	for i := range new.shards {
+		new.shards[i] = newShard()
+	}
+	new.updateMetrics()
 	return new
 }
 
-func (lru *Queue) getTail() *Node {
-	return lru.tail
-}
-
-func (lru *Queue) getHead() *Node {
-	return lru.head
+func (lru *Queue) shardFor(bucket string, fkey string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(bucket + "/" + fkey))
+	return lru.shards[h.Sum32()%numShards]
 }
 
 //Retrieve page from global LRU
 func (lru *Queue) Retrieve(fkey string, bucket string) (*Node, bool) {
-	if lru.currFiles == 0 {
+	//read before locking, a reload resizes the queue while holding the live settings
+	maxMemSize := lru.args.MaxMemSize()
+	s := lru.shardFor(bucket, fkey)
+	s.mutex.Lock()
+	node, ok := s.index[bucket+"/"+fkey]
+	if !ok {
+		s.mutex.Unlock()
 		return nil, false
 	}
-	if lru.currFiles == 1 {
-		tmp := lru.getHead()
-		if tmp.Fkey == fkey && tmp.Bucket == bucket {
-			return tmp, true
+	if expired(node) == true {
+		s.mutex.Unlock()
+		lru.expire(node)
+		return nil, false
+	}
+	s.moveToHead(node)
+	promote := false
+	if node.Inmem == false && node.promoting == false && lru.args.PromoteAfter > 0 && node.size < maxMemSize {
+		node.hits++
+		if node.hits >= lru.args.PromoteAfter {
+			node.promoting = true
+			promote = true
 		}
 	}
+	s.mutex.Unlock()
+	if promote == true {
+		go lru.promote(node)
+	}
+	log.Debugln(fkey, "is in local cache", node)
+	return node, true
+}
 
-	tmp := lru.getHead()
-	for i := 0; i < lru.currFiles-1; i++ {
-		if tmp.Fkey == fkey && tmp.Bucket == bucket {
-			lru.moveToHead(tmp)
-			log.Debugln(fkey, "is in local cache", tmp)
-			return tmp, true
+//Peek looks an object up without counting it as used.  Like Nodes it returns a copy
+func (lru *Queue) Peek(fkey string, bucket string) *Node {
+	s := lru.shardFor(bucket, fkey)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	node, ok := s.index[bucket+"/"+fkey]
+	if !ok {
+		return nil
+	}
+	copied := *node
+	copied.prev = nil
+	copied.next = nil
+	return &copied
+}
+
+func unpinned(n *Node) bool {
+	return n.Pinned == false
+}
+
+func inMem(n *Node) bool {
+	return n.Inmem == true
+}
+
+//oldest finds the least recently used node match accepts, looking at every shard.  It is
+//returned with its shard locked, or nil if there is none.  The caller holds spaceMutex
+func (lru *Queue) oldest(match func(*Node) bool) (*Node, *shard) {
+	for {
+		var oldest *Node
+		var oldestUsed time.Time
+		var from *shard
+		for _, s := range lru.shards {
+			s.mutex.Lock()
+			if n := s.leastRecent(match); n != nil && (oldest == nil || n.lastUsed.Before(oldestUsed)) {
+				oldest = n
+				oldestUsed = n.lastUsed
+				from = s
+			}
+			s.mutex.Unlock()
+		}
+		if oldest == nil {
+			return nil, nil
+		}
+		from.mutex.Lock()
+		//the node may have been used, pinned or removed since we looked
+		if from.leastRecent(match) == oldest {
+			return oldest, from
+		}
+		from.mutex.Unlock()
+	}
+}
+
+//evict drops the least recently used object in a cache directory that isn't pinned from the
+//cache, disk copy and all.  It returns false if there is nothing left that can be evicted.
+//The caller holds spaceMutex
+func (lru *Queue) evict(d *cacheDir) bool {
+	return lru.evictFrom(func(n *Node) bool { return n.dir == d })
+}
+
+//evictFrom evicts the least recently used unpinned object match accepts, from the lowest
+//retention priority that has one.  The caller holds spaceMutex
+func (lru *Queue) evictFrom(match func(*Node) bool) bool {
+	var node *Node
+	var s *shard
+	for _, p := range lru.priorities {
+		node, s = lru.oldest(func(n *Node) bool { return match(n) && unpinned(n) && priority(n) == p })
+		if node != nil {
+			break
 		}
-		tmp = tmp.next
 	}
-	return nil, false
+	if node == nil {
+		return false
+	}
+	s.unlink(node)
+	lru.removeFiles(node)
+	s.mutex.Unlock()
+	lru.release(node)
+	metrics.Evictions.Inc()
+	return true
 }
 
-func (lru *Queue) evict() {
-	//evict current tail and adjust len -1 node to be new tail
-	currT := lru.getTail()
+//demote drops the least recently used object from memory, it stays cached on disk.  Pinned
+//objects are demoted too, pinning only keeps them in the cache.  It returns false if nothing
+//is in memory.  The caller holds spaceMutex
+func (lru *Queue) demote() bool {
+	return lru.demoteFrom(func(n *Node) bool { return true })
+}
 
-	os.Remove(lru.args.LocalPath + currT.Fkey)
-	newT := currT.prev
-	newT.next = nil
-	//currT.next = nil
+//demoteFrom demotes the least recently used object in memory match accepts, from the lowest
+//retention priority that has one.  The caller holds spaceMutex
+func (lru *Queue) demoteFrom(match func(*Node) bool) bool {
+	var node *Node
+	var s *shard
+	for _, p := range lru.priorities {
+		node, s = lru.oldest(func(n *Node) bool { return match(n) && inMem(n) && priority(n) == p })
+		if node != nil {
+			break
+		}
+	}
+	if node == nil {
+		return false
+	}
+	onDisk := *node
+	onDisk.Inmem = false
+	onDisk.MemFile = nil
+	onDisk.hits = 0
+	s.replace(node, &onDisk)
+	s.mutex.Unlock()
+	lru.dropMem(node)
+	lru.updateMetrics()
+	metrics.Demotions.Inc()
+	return true
+}
 
-	lru.tail = currT.prev
+//promote reads a disk cached object into memory, demoting others if memory is full.  The
+//content is checked against the node's checksum first so a corrupt copy isn't spread
+func (lru *Queue) promote(node *Node) {
+	key := node.Bucket + "/" + node.Fkey
+	s := lru.shardFor(node.Bucket, node.Fkey)
+	data, err := lru.ReadStored(node.LocalFname)
+	if err == nil && node.Checksum != "" {
+		hash := sha256.New()
+		content := Decode(bytes.NewReader(data), node.Encoding, node.Length)
+		_, err = io.Copy(hash, content)
+		content.Close()
+		if err == nil && hex.EncodeToString(hash.Sum(nil)) != node.Checksum {
+			err = errors.New("content doesn't match its checksum")
+		}
+	}
+
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	//nothing is removed without spaceMutex, so if the node is still queued now it stays
+	s.mutex.Lock()
+	queued := s.index[key] == node
+	if err != nil || queued == false || node.size > lru.memCap {
+		node.promoting = false
+		node.hits = 0
+		s.mutex.Unlock()
+		if err != nil {
+			log.Warnln("Could not promote", key, "into memory:", err)
+		}
+		return
+	}
+	s.mutex.Unlock()
+	//the rule's share of memory is made room for among its own objects, which leaves the node queued
+	if lru.fitMemShare(node) == false {
+		s.mutex.Lock()
+		node.promoting = false
+		node.hits = 0
+		s.mutex.Unlock()
+		return
+	}
+
+	//demoting takes other shard locks, so room is made before this one is held
+	mem := sharedMem(node)
+	if mem == nil {
+		for lru.currMem+node.size > lru.memCap {
+			if lru.demote() == false {
+				break
+			}
+		}
+		mem = NewMemFile(data)
+	}
+	//Retrieve moves and counts the node under the shard lock, so it's copied under it too
+	s.mutex.Lock()
+	if s.index[key] != node {
+		s.mutex.Unlock()
+		return
+	}
+	inMem := *node
+	inMem.Inmem = true
+	inMem.MemFile = mem
+	inMem.hits = 0
+	inMem.promoting = false
+	s.replace(node, &inMem)
+	s.mutex.Unlock()
+	lru.addMem(&inMem)
+	lru.updateMetrics()
+	metrics.Promotions.Inc()
+	log.Debugln("Promoted", key, "into memory")
+}
+
+//removeFiles deletes a dropped node's local copy.  The caller holds the node's shard lock,
+//which Store takes to rename a plain file into place, and a file Stored since for the same key
+//is still pending, so a newer copy under the same name is never deleted
+func (lru *Queue) removeFiles(n *Node) {
+	if n.blob == nil && lru.shardFor(n.Bucket, n.Fkey).pending[n.LocalFname] == 0 {
+		os.Remove(n.LocalFname) //a blob goes with its last reference, see dropDisk
+	}
+	removeMetadata(n.dir, n.Bucket, n.Fkey)
+}
+
+//release gives back a dropped node's space.  The caller holds spaceMutex
+func (lru *Queue) release(n *Node) {
 	lru.currFiles--
-	lru.currMem -= currT.size
-	lru.currDisk -= currT.size
+	if n.Inmem == true {
+		lru.dropMem(n)
+	}
+	lru.dropDisk(n)
+	lru.updateMetrics()
 
 	if lru.args.Cluster == true {
-		go hashes.Ghash.RemoveFromGH(currT.Fkey, currT.Bucket, true)
+		go hashes.Ghash.RemoveFromGH(n.Fkey, n.Bucket, true)
 	}
+}
 
-	return
+func (lru *Queue) updateMetrics() {
+	metrics.CacheFiles.Set(float64(lru.currFiles))
+	metrics.CacheBytes.WithLabelValues("mem").Set(float64(lru.currMem))
+	used, capacity := lru.disk()
+	metrics.CacheBytes.WithLabelValues("disk").Set(float64(used))
+	metrics.CacheCapacity.WithLabelValues("mem").Set(float64(lru.memCap))
+	metrics.CacheCapacity.WithLabelValues("disk").Set(float64(capacity))
+	lru.dirMetrics()
 }
 
-func (lru *Queue) moveToHead(move *Node) {
-	//add new node to head of queue and shift current head down 1
-	tmp := lru.getHead()
-	if tmp.Fkey == move.Fkey {
-		return
+//Remove drops a single object from the local cache, if present
+func (lru *Queue) Remove(fkey string, bucket string) bool {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	s := lru.shardFor(bucket, fkey)
+	s.mutex.Lock()
+	node, ok := s.index[bucket+"/"+fkey]
+	if ok {
+		s.unlink(node)
+		lru.removeFiles(node)
+	}
+	s.mutex.Unlock()
+	if ok {
+		lru.release(node)
 	}
+	return ok
+}
 
-	//if node in queue find it and move it to head, then clean up linked list
-	if lru.currFiles > 1 {
-		for i := 0; i < lru.currFiles-1; i++ {
-			if tmp.Fkey == move.Fkey && tmp.Bucket == move.Bucket {
-				prev := tmp.prev
-				if tmp.next != nil {
-					next := tmp.next
-					next.prev = prev
-					prev.next = next
-				} else {
-					prev.next = nil
-					lru.tail = prev
-				}
-				break
+//Purge drops every object in bucket whose key starts with prefix and returns their keys
+func (lru *Queue) Purge(bucket string, prefix string) []string {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	var purged []string
+	for _, s := range lru.shards {
+		var dropped []*Node
+		s.mutex.Lock()
+		for _, node := range s.index {
+			if node.Bucket == bucket && strings.HasPrefix(node.Fkey, prefix) {
+				s.unlink(node)
+				lru.removeFiles(node)
+				dropped = append(dropped, node)
 			}
-			tmp = tmp.next
 		}
-		oldH := lru.getHead()
-		move.next = oldH
-		move.prev = nil
-		oldH.prev = move
-		lru.head = move
+		s.mutex.Unlock()
+		for _, node := range dropped {
+			lru.release(node)
+			purged = append(purged, node.Fkey)
+		}
 	}
-	return
+	sort.Strings(purged)
+	return purged
 }
 
-//Add missing file to LRU.  new file goes to head of queue
-func (lru *Queue) Add(bucket string, fkey string, size int64, inmem bool, data []byte) (*Node, error) {
-	//add node to LRU queue and evict if already full
-	_, queued := lru.Retrieve(fkey, bucket)
+//Pin or unpin an object, returns false if it isn't cached.  It fails with ErrPinnedFull if
+//pinned objects would take more than their cache directory's capacity, and ErrRulePinned for
+//unpinning an object its retention rule pins
+func (lru *Queue) Pin(fkey string, bucket string, pinned bool) (bool, error) {
+	changed, node, err := lru.pin(fkey, bucket, pinned)
+	if changed == true {
+		lru.persist(node)
+	}
+	return node != nil, err
+}
+
+func (lru *Queue) pin(fkey string, bucket string, pinned bool) (bool, *Node, error) {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	s := lru.shardFor(bucket, fkey)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	node, ok := s.index[bucket+"/"+fkey]
+	if ok == false {
+		return false, nil, nil
+	}
+	if node.Pinned == pinned {
+		return false, node, nil
+	}
+	if pinned == false && node.rule != nil && node.rule.Pinned == true {
+		return false, node, ErrRulePinned
+	}
+	if pinned == true && node.dir.pinned+pinnedAdds(node) > node.dir.capacity {
+		return false, node, ErrPinnedFull
+	}
+	node.Pinned = pinned
+	if pinned == true {
+		addPinned(node)
+	} else {
+		dropPinned(node)
+	}
+	return true, node, nil
+}
+
+//expire drops a node Retrieve found past its MaxAge, unless it was replaced meanwhile
+func (lru *Queue) expire(node *Node) {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	s := lru.shardFor(node.Bucket, node.Fkey)
+	s.mutex.Lock()
+	queued := s.index[node.Bucket+"/"+node.Fkey] == node
 	if queued == true {
-		return nil, nil
+		s.unlink(node)
+		lru.removeFiles(node)
+	}
+	s.mutex.Unlock()
+	if queued == true {
+		lru.release(node)
+		log.Debugln("Expired", node.Bucket, node.Fkey)
+	}
+}
+
+//Resize changes the queue's capacity, evicting objects until what's cached fits.  Pinned
+//objects are kept even if that leaves the queue over capacity.  diskCap only applies to
+//LocalPath, configured CacheDirs keep their own capacities
+func (lru *Queue) Resize(memCap int64, diskCap int64) {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	lru.memCap = memCap
+	if len(lru.args.CacheDirs) == 0 {
+		lru.dirs[0].capacity = diskCap
+	}
+	for _, d := range lru.dirs {
+		for d.used > d.capacity {
+			if lru.evict(d) == false {
+				log.Errorln("Pinned objects take", d.pinned, "bytes, more than the capacity of", d.path, d.capacity)
+				break
+			}
+		}
+	}
+	for lru.currMem > lru.memCap {
+		if lru.demote() == false {
+			break
+		}
+	}
+	lru.updateMetrics()
+}
+
+//Stats of the queue's current occupancy
+func (lru *Queue) Stats() Stats {
+	lru.spaceMutex.Lock()
+	stats := Stats{Files: lru.currFiles, MemUsed: lru.currMem, MemCap: lru.memCap, Draining: lru.draining}
+	stats.DiskUsed, stats.DiskCap = lru.disk()
+	stats.Blobs = len(lru.blobs)
+	stats.DedupSaved = lru.dedupSaved()
+	stats.Rules = lru.ruleStats()
+	for _, d := range lru.dirs {
+		stats.PinnedBytes += d.pinned
+		stats.Dirs = append(stats.Dirs, DirStats{Path: d.path, Capacity: d.capacity, Used: d.used,
+			Pinned: d.pinned, Files: d.files, Healthy: d.healthy, FSUsed: d.fsUsed, Critical: d.critical})
+	}
+	lru.spaceMutex.Unlock()
+	for _, s := range lru.shards {
+		s.mutex.Lock()
+		for _, node := range s.index {
+			if node.Pinned == true {
+				stats.Pinned++
+			}
+			if node.Inmem == true {
+				stats.MemFiles++
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return stats
+}
+
+//Drain stops advertising new objects to peers.  Withdrawing the ones already advertised
+//is up to the caller, see hashes.Gh.Leave
+func (lru *Queue) Drain() {
+	lru.spaceMutex.Lock()
+	lru.draining = true
+	lru.spaceMutex.Unlock()
+}
+
+//Draining is true once Drain has been called
+func (lru *Queue) Draining() bool {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	return lru.draining
+}
+
+//Size of the cached object in bytes, as stored
+func (n *Node) Size() int64 {
+	return n.size
+}
+
+//Nodes returns a snapshot of the queued nodes, most recently used first.  The nodes are
+//copies, so their Pinned flag is as of the call
+func (lru *Queue) Nodes() []*Node {
+	var nodes []*Node
+	for _, s := range lru.shards {
+		s.mutex.Lock()
+		for _, node := range s.index {
+			copied := *node
+			copied.prev = nil
+			copied.next = nil
+			nodes = append(nodes, &copied)
+		}
+		s.mutex.Unlock()
 	}
-	new := &Node{dirty: false, Bucket: bucket, Fkey: fkey,
-		LocalFname: lru.args.LocalPath + bucket + fkey,
-		size:       size, ModTime: time.Now(), prev: nil, next: nil}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].lastUsed.After(nodes[j].lastUsed) })
+	return nodes
+}
+
+//Add missing file to LRU.  new file goes to head of queue.  localFname is where the caller
+//wrote it, in the cache directory Place picked.  size is what it takes there and in memory,
+//length the content's own size, which differ when it is compressed with encoding.  If the
+//object is already queued its node is replaced, keeping whether it was pinned.  Its retention
+//rule may pin it, and limits the space it and the rule's other objects take
+func (lru *Queue) Add(bucket string, fkey string, localFname string, size int64, inmem bool, data []byte, meta *Metadata, checksum string, encoding string, length int64) (*Node, error) {
+	new := &Node{dirty: false, Bucket: bucket, Fkey: fkey, LocalFname: localFname, dir: lru.dirOf(localFname),
+		size: size, Length: length, Encoding: encoding, Meta: meta, Checksum: checksum, Added: time.Now(),
+		ModTime: meta.LastModified, prev: nil, next: nil}
 	if inmem == true {
 		new.Inmem = true
-		newMem := &MemFile{offset: 0, dirOffset: 0, Content: data}
-		new.MemFile = newMem
+		new.MemFile = NewMemFile(data)
 	} else {
 		new.Inmem = false
 	}
+	node, err := lru.add(new)
+	if err == nil {
+		lru.persist(node)
+	}
+	return node, err
+}
+
+//add queues a new node, Pinned if it was pinned already.  The caller persists it
+func (lru *Queue) add(new *Node) (*Node, error) {
+	bucket, fkey, localFname, size := new.Bucket, new.Fkey, new.LocalFname, new.size
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	//the directory may have failed since Place picked it
+	d := new.dir
+	if d == nil || d.healthy == false {
+		return nil, ErrNoDir
+	}
+	new.blob = lru.blobAt(localFname)
+	new.rule = lru.ruleFor(bucket, fkey)
+	new.Pinned = new.Pinned || new.rule != nil && new.rule.Pinned == true
+	s := lru.shardFor(bucket, fkey)
 
-	//pop objects off the end of the queue if we need room
+	//an overwritten object gives its space back first
+	s.mutex.Lock()
+	old, queued := s.index[bucket+"/"+fkey]
+	if queued == true {
+		new.Pinned = new.Pinned || old.Pinned
+		s.unlink(old)
+		if old.LocalFname != localFname {
+			lru.removeFiles(old)
+		}
+	}
+	s.mutex.Unlock()
+	if queued == true {
+		lru.currFiles--
+		if old.Inmem == true {
+			lru.dropMem(old)
+		}
+		lru.dropDisk(old)
+	}
+
+	//not caching it drops what was cached of the object before
+	fail := func(err error) (*Node, error) {
+		s.mutex.Lock()
+		removeMetadata(d, bucket, fkey)
+		s.mutex.Unlock()
+		lru.updateMetrics()
+		if queued == true && lru.args.Cluster == true {
+			go hashes.Ghash.RemoveFromGH(fkey, bucket, true)
+		}
+		return nil, err
+	}
+	//pinned objects count against the capacity, and there has to be room for them all
+	if new.Pinned == true && d.pinned+pinnedAdds(new) > d.capacity {
+		log.Errorln("Pinning", bucket, fkey, "would take", d.pinned+pinnedAdds(new), "bytes, more than the capacity of", d.path, d.capacity)
+		return fail(ErrPinnedFull)
+	}
+	//a rule's objects make room among themselves once they've used their share
+	if lru.fitDiskShare(new) == false {
+		return fail(ErrShareFull)
+	}
+	//pop objects off the end of the queue if we need room on disk, where every object is kept.
+	//Content already in a blob takes no more
 	for {
-		if ((lru.currMem+size > lru.memCap) && inmem == true) || (lru.currDisk+size) > lru.diskCap {
-			log.Debugln("Check evict state: ", fkey, inmem, lru.currMem+size, lru.memCap, lru.currDisk+size, lru.diskCap, lru.args.MaxMemFileSize)
-			lru.evict()
+		if (new.blob == nil || new.blob.refs == 0) && (d.used+size) > d.capacity {
+			log.Debugln("Check evict state: ", fkey, d.path, d.used+size, d.capacity)
+			if lru.evict(d) == false {
+				if d.pinned+size > d.capacity {
+					return fail(ErrPinnedFull)
+				}
+				return fail(ErrNoRoom)
+			}
 		} else {
 			break
 		}
 
 	}
-	if lru.args.Cluster == true {
+	//and in memory for a small object, demoting others.  If it doesn't fit it's on disk only
+	if new.Inmem == true && sharedMem(new) == nil && lru.fitMemShare(new) == false {
+		new.Inmem = false
+		new.MemFile = nil
+	}
+	for new.Inmem == true && sharedMem(new) == nil && lru.currMem+size > lru.memCap {
+		if lru.demote() == false {
+			new.Inmem = false
+			new.MemFile = nil
+		}
+	}
+	if mem := sharedMem(new); new.Inmem == true && mem != nil {
+		new.MemFile = mem
+	}
+	if lru.args.Cluster == true && lru.draining == false {
 		go hashes.Ghash.AddToGH(fkey, bucket, lru.args.LocalName, true)
 	}
 
-	if lru.currFiles == 0 {
-		lru.head = new
-		lru.tail = new
-		lru.currFiles++
-		lru.currMem += size
-		lru.currDisk += size
-		return new, nil
+	s.mutex.Lock()
+	if new.blob == nil {
+		if s.pending[localFname]--; s.pending[localFname] <= 0 {
+			delete(s.pending, localFname)
+		}
 	}
-
-	lru.moveToHead(new)
+	s.index[bucket+"/"+fkey] = new
+	s.moveToHead(new)
+	s.mutex.Unlock()
 	lru.currFiles++
-	lru.currMem += size
-	lru.currDisk += size
+	if new.Inmem == true {
+		lru.addMem(new)
+	}
+	lru.addDisk(new)
+	if new.blob != nil {
+		new.blob.pending--
+	}
+	lru.updateMetrics()
 	return new, nil
 }
+
+//Verify rehashes the cached content and checks it against the stored checksum.  For a node in
+//memory the cache file is checked too, it's what's served once the node is demoted.  It only
+//returns false without an error for content that's damaged, see damaged
+func (lru *Queue) Verify(n *Node) (bool, error) {
+	if n.Checksum == "" {
+		return true, nil
+	}
+	if n.Inmem == true {
+		content, err := lru.Open(n)
+		if ok, errV := verify(content, err, n.Checksum); ok == false {
+			return false, errV
+		}
+	}
+	content, err := lru.openDisk(n)
+	return verify(content, err, n.Checksum)
+}
+
+func verify(content *Decoder, err error, checksum string) (bool, error) {
+	if err != nil {
+		return false, damaged(err)
+	}
+	defer content.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, content); err != nil {
+		return false, damaged(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == checksum, nil
+}
+
+//damaged sorts out an error reading cached content.  Failing to read the file, or to find the
+//master key it's encrypted with, says nothing about the content and the error is returned.
+//Anything else, content that fails authentication or is cut short or can't be decompressed,
+//is damage and nil is returned
+func damaged(err error) error {
+	if _, ok := err.(*os.PathError); ok == true || err == ErrUnknownKey {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,491 @@
+package queues
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"s3envoy/loadArgs"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//newTestQueue is a queue in a temp dir of its own, which the caller removes.  conf adds to
+//or overrides the defaults of a single node memory backed cache
+func newTestQueue(t *testing.T, conf map[string]interface{}) *Queue {
+	dir, err := ioutil.TempDir("", "s3envoy-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := map[string]interface{}{"LocalPath": dir + "/", "Cluster": "False", "Backend": "memory"}
+	for k, v := range conf {
+		settings[k] = v
+	}
+	data, _ := json.Marshal(settings)
+	if err = ioutil.WriteFile(dir+"/config.json", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	args, errs := loadArgs.Validate(dir + "/config.json")
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	return InitializeQueue(args)
+}
+
+//store stores content under key the way a PUT does, unencrypted and uncompressed, and returns
+//the file name to Add it under, its checksum and stored size.  It doesn't fail the test itself,
+//so it can be called from any goroutine
+func store(lru *Queue, key string, content []byte) (string, string, int64, error) {
+	localFname, err := lru.Place("bkt", key, int64(len(content)))
+	if err != nil {
+		return "", "", 0, err
+	}
+	w, err := lru.NewWriter(localFname, "")
+	if err != nil {
+		return "", "", 0, err
+	}
+	w.Write(content)
+	file, _, size, err := w.Finish()
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer file.Close()
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	if localFname, err = lru.Store(file, "bkt", key, localFname, checksum, "", false); err != nil {
+		os.Remove(file.Name())
+		return "", "", 0, err
+	}
+	return localFname, checksum, size, nil
+}
+
+//cache stores content under key and Adds it, like store from any goroutine
+func cache(lru *Queue, key string, content []byte, inmem bool) (*Node, error) {
+	localFname, checksum, size, err := store(lru, key, content)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if inmem == true {
+		data = content
+	}
+	node, err := lru.Add("bkt", key, localFname, size, inmem, data, &Metadata{}, checksum, "", int64(len(content)))
+	if err != nil {
+		lru.Discard("bkt", key, localFname)
+	}
+	return node, err
+}
+
+//checkQueue fails unless every shard's list matches its index and the space accounted for
+//is what the queued nodes take, blobs counted once
+func checkQueue(t *testing.T, lru *Queue) {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	files := 0
+	var mem int64
+	used := make(map[*cacheDir]int64)
+	pinned := make(map[*cacheDir]int64)
+	blobs := make(map[*blob]bool)
+	memBlobs := make(map[*blob]bool)
+	pinnedBlobs := make(map[*blob]bool)
+	rules := make(map[*rule]*rule)
+	for i, s := range lru.shards {
+		s.mutex.Lock()
+		listed := 0
+		var prev *Node
+		for n := s.head; n != nil; n = n.next {
+			if n.prev != prev {
+				t.Errorf("shard %d: %s links back to the wrong node", i, n.Fkey)
+			}
+			if s.index[n.Bucket+"/"+n.Fkey] != n {
+				t.Errorf("shard %d: %s is listed but not indexed", i, n.Fkey)
+			}
+			prev = n
+			listed++
+			if n.rule != nil {
+				if rules[n.rule] == nil {
+					rules[n.rule] = &rule{}
+				}
+				rules[n.rule].files++
+				rules[n.rule].disk += n.size
+				if n.Inmem == true {
+					rules[n.rule].mem += n.size
+				}
+			}
+			if n.blob == nil || blobs[n.blob] == false {
+				used[n.dir] += n.size
+			}
+			if n.Pinned == true && (n.blob == nil || pinnedBlobs[n.blob] == false) {
+				pinned[n.dir] += n.size
+			}
+			if n.Inmem == true && (n.blob == nil || memBlobs[n.blob] == false) {
+				mem += n.size
+			}
+			if n.blob != nil {
+				blobs[n.blob] = true
+				if n.Inmem == true {
+					memBlobs[n.blob] = true
+				}
+				if n.Pinned == true {
+					pinnedBlobs[n.blob] = true
+				}
+			}
+		}
+		if s.tail != prev {
+			t.Errorf("shard %d: tail isn't the last node", i)
+		}
+		if listed != len(s.index) {
+			t.Errorf("shard %d: %d nodes listed, %d indexed", i, listed, len(s.index))
+		}
+		files += listed
+		s.mutex.Unlock()
+	}
+	if files != lru.currFiles {
+		t.Errorf("%d files queued, %d counted", files, lru.currFiles)
+	}
+	if mem != lru.currMem {
+		t.Errorf("%d bytes in memory, %d counted", mem, lru.currMem)
+	}
+	if lru.currMem > lru.memCap {
+		t.Errorf("%d bytes in memory, more than the %d there is", lru.currMem, lru.memCap)
+	}
+	for _, r := range lru.rules {
+		counted := rules[r]
+		if counted == nil {
+			counted = &rule{}
+		}
+		if counted.files != r.files || counted.disk != r.disk || counted.mem != r.mem {
+			t.Errorf("rule %s%s: %d files of %d bytes, %d in memory, counted %d, %d and %d", r.Bucket, r.Prefix,
+				counted.files, counted.disk, counted.mem, r.files, r.disk, r.mem)
+		}
+	}
+	for _, d := range lru.dirs {
+		if used[d] != d.used {
+			t.Errorf("%s: %d bytes on disk, %d counted", d.path, used[d], d.used)
+		}
+		if pinned[d] != d.pinned {
+			t.Errorf("%s: %d bytes pinned, %d counted", d.path, pinned[d], d.pinned)
+		}
+	}
+}
+
+func TestConcurrentPromote(t *testing.T) {
+	lru := newTestQueue(t, map[string]interface{}{"MemCap": "2K", "DiskCap": "1M", "MaxMemFileSize": "1K",
+		"PromoteAfter": 1})
+	defer os.RemoveAll(lru.args.LocalPath)
+	for i := 0; i < 12; i++ {
+		if _, err := cache(lru, fmt.Sprintf("k%d", i), content(512), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//every read promotes, and memory fits 4 of them, so reads race promotions and demotions
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20000; i++ {
+				lru.Retrieve(fmt.Sprintf("k%d", (i*7+w)%12), "bkt")
+			}
+		}(w)
+	}
+	wg.Wait()
+	waitPromoted(lru)
+	checkQueue(t, lru)
+}
+
+//waitPromoted waits for the promotions Retrieve started to finish
+func waitPromoted(lru *Queue) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		busy := false
+		for _, s := range lru.shards {
+			s.mutex.Lock()
+			for _, n := range s.index {
+				busy = busy || n.promoting
+			}
+			s.mutex.Unlock()
+		}
+		if busy == false {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPinSharedBlob(t *testing.T) {
+	lru := newTestQueue(t, map[string]interface{}{"DiskCap": "1500B", "Dedup": "True"})
+	defer os.RemoveAll(lru.args.LocalPath)
+	same := content(1024)
+	for _, key := range []string{"a", "b"} {
+		if _, err := cache(lru, key, same, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the content is on disk once, so it's pinned once
+	for _, key := range []string{"a", "b"} {
+		if _, err := lru.Pin(key, "bkt", true); err != nil {
+			t.Fatalf("pinning %s: %v", key, err)
+		}
+	}
+	if pinned := lru.Stats().PinnedBytes; pinned != 1024 {
+		t.Fatalf("%d bytes pinned, expected 1024", pinned)
+	}
+	if _, err := cache(lru, "c", content(400), false); err != nil {
+		t.Fatalf("no room next to the shared pinned content: %v", err)
+	}
+	checkQueue(t, lru)
+
+	lru.Pin("a", "bkt", false)
+	if pinned := lru.Stats().PinnedBytes; pinned != 1024 {
+		t.Fatalf("%d bytes pinned with b still pinned, expected 1024", pinned)
+	}
+	lru.Remove("b", "bkt")
+	if pinned := lru.Stats().PinnedBytes; pinned != 0 {
+		t.Fatalf("%d bytes pinned with nothing pinned, expected 0", pinned)
+	}
+	checkQueue(t, lru)
+}
+
+func TestDropDirKeepsBlobs(t *testing.T) {
+	lru := newTestQueue(t, map[string]interface{}{"Dedup": "True"})
+	defer os.RemoveAll(lru.args.LocalPath)
+	node, err := cache(lru, "a", content(100), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lru.spaceMutex.Lock()
+	d := lru.dirs[0]
+	d.healthy = false
+	lru.dropDir(d)
+	blobs := len(lru.blobs)
+	lru.spaceMutex.Unlock()
+	if blobs != 0 {
+		t.Fatalf("%d blobs still known after their directory failed", blobs)
+	}
+	if _, err = os.Stat(node.LocalFname); err != nil {
+		t.Fatalf("the blob in the failed directory was touched: %v", err)
+	}
+}
+
+//read is the content of a cached object, without counting it as used
+func read(t *testing.T, lru *Queue, key string) []byte {
+	node := lru.Peek(key, "bkt")
+	if node == nil {
+		t.Fatalf("%s isn't cached", key)
+	}
+	content, err := lru.Open(node)
+	if err != nil {
+		t.Fatalf("opening %s: %v", key, err)
+	}
+	defer content.Close()
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	return data
+}
+
+//cacheFiles counts the object files in the queue's cache dir, blobs included
+func cacheFiles(lru *Queue) int {
+	files := 0
+	filepath.Walk(lru.args.LocalPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() == true && strings.Contains(path, "/"+metaDir+"/") == false &&
+			filepath.Base(path) != "config.json" {
+			files++
+		}
+		return nil
+	})
+	return files
+}
+
+func TestAccounting(t *testing.T) {
+	lru := newTestQueue(t, map[string]interface{}{"DiskCap": "4KiB", "MemCap": "2KiB", "MaxMemFileSize": "1KiB",
+		"PromoteAfter": 0})
+	defer os.RemoveAll(lru.args.LocalPath)
+
+	//four fit on disk, the oldest are evicted for the rest
+	for i := 0; i < 10; i++ {
+		if _, err := cache(lru, fmt.Sprintf("k%d", i), content(1000), i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+		checkQueue(t, lru)
+	}
+	if stats := lru.Stats(); stats.Files != 4 || stats.DiskUsed != 4000 {
+		t.Fatalf("%d files taking %d bytes cached, expected 4 taking 4000", stats.Files, stats.DiskUsed)
+	}
+	if files := cacheFiles(lru); files != 4 {
+		t.Fatalf("%d files left on disk for 4 objects", files)
+	}
+	for i := 0; i < 6; i++ {
+		if lru.Peek(fmt.Sprintf("k%d", i), "bkt") != nil {
+			t.Fatalf("k%d wasn't evicted", i)
+		}
+	}
+
+	//an overwrite takes the old copy's place, in whatever tier the new one goes to
+	for _, inmem := range []bool{true, false, true} {
+		data := content(700)
+		if _, err := cache(lru, "k9", data, inmem); err != nil {
+			t.Fatal(err)
+		}
+		if got := read(t, lru, "k9"); bytes.Equal(got, data) == false {
+			t.Fatal("read back the old copy after an overwrite")
+		}
+		if node := lru.Peek("k9", "bkt"); node.Inmem != inmem {
+			t.Fatalf("overwritten copy in memory is %v, expected %v", node.Inmem, inmem)
+		}
+		checkQueue(t, lru)
+	}
+	if files := cacheFiles(lru); files != 4 {
+		t.Fatalf("%d files left on disk for 4 objects after overwriting", files)
+	}
+
+	if purged := lru.Purge("bkt", "k"); len(purged) != 4 {
+		t.Fatalf("purged %v", purged)
+	}
+	checkQueue(t, lru)
+	if stats := lru.Stats(); stats.Files != 0 || stats.DiskUsed != 0 || stats.MemUsed != 0 || stats.Dirs[0].Files != 0 {
+		t.Fatalf("nothing cached, but stats are %+v", stats)
+	}
+	if files := cacheFiles(lru); files != 0 {
+		t.Fatalf("%d files left on disk with nothing cached", files)
+	}
+}
+
+func TestPromoteDemote(t *testing.T) {
+	lru := newTestQueue(t, map[string]interface{}{"MemCap": "2KiB", "MaxMemFileSize": "1KiB", "PromoteAfter": 2})
+	defer os.RemoveAll(lru.args.LocalPath)
+	contents := make(map[string][]byte)
+	for _, key := range []string{"a", "b", "c", "damaged"} {
+		contents[key] = content(1000)
+		if _, err := cache(lru, key, contents[key], false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inMemory := func(keys ...string) {
+		for _, key := range []string{"a", "b", "c", "damaged"} {
+			want := false
+			for _, k := range keys {
+				want = want || k == key
+			}
+			if node := lru.Peek(key, "bkt"); node.Inmem != want {
+				t.Fatalf("%s in memory is %v, expected %v", key, node.Inmem, want)
+			}
+		}
+	}
+	touch := func(key string, times int) {
+		for i := 0; i < times; i++ {
+			lru.Retrieve(key, "bkt")
+		}
+		waitPromoted(lru)
+	}
+
+	touch("a", 1)
+	inMemory()
+	touch("a", 1)
+	inMemory("a")
+	touch("b", 2)
+	inMemory("a", "b")
+	//memory fits two, so the least recently used one is demoted
+	touch("c", 2)
+	inMemory("b", "c")
+	for key, data := range contents {
+		if got := read(t, lru, key); bytes.Equal(got, data) == false {
+			t.Fatalf("%s changed moving between tiers", key)
+		}
+	}
+	checkQueue(t, lru)
+
+	//a copy that doesn't match its checksum stays on disk
+	ioutil.WriteFile(lru.Peek("damaged", "bkt").LocalFname, content(1000), 0644)
+	touch("damaged", 2)
+	inMemory("b", "c")
+	checkQueue(t, lru)
+}
+
+func TestConcurrentQueue(t *testing.T) {
+	for _, dedup := range []string{"False", "True"} {
+		lru := newTestQueue(t, map[string]interface{}{"DiskCap": "16KiB", "MemCap": "4KiB", "MaxMemFileSize": "1KiB",
+			"PromoteAfter": 2, "Dedup": dedup})
+		defer os.RemoveAll(lru.args.LocalPath)
+		//few enough contents that Dedup shares them
+		var contents [][]byte
+		for i := 0; i < 5; i++ {
+			contents = append(contents, content(300*(i+1)))
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 300; i++ {
+					key := fmt.Sprintf("k%d", (i*13+w*7)%30)
+					switch i % 6 {
+					case 0, 1:
+						cache(lru, key, contents[(i+w)%len(contents)], i%4 == 0)
+					case 2, 3:
+						if node, ok := lru.Retrieve(key, "bkt"); ok == true {
+							if content, err := lru.Open(node); err == nil {
+								ioutil.ReadAll(content)
+								content.Close()
+							}
+						}
+					case 4:
+						lru.Remove(key, "bkt")
+					case 5:
+						lru.Pin(key, "bkt", i%12 == 5)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		waitPromoted(lru)
+		checkQueue(t, lru)
+
+		lru.Purge("bkt", "")
+		checkQueue(t, lru)
+		if files := cacheFiles(lru); files != 0 {
+			t.Fatalf("dedup %s: %d files left on disk with nothing cached", dedup, files)
+		}
+		if len(lru.blobs) != 0 {
+			t.Fatalf("dedup %s: %d blobs left with nothing cached", dedup, len(lru.blobs))
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, keys := range [][][]byte{nil, {newKey(t)}} {
+		lru := newSealQueue(t, keys...)
+		defer os.RemoveAll(lru.args.LocalPath)
+		check := func(what string, key string, wantOK bool, wantErr bool) {
+			ok, err := lru.Verify(lru.Peek(key, "bkt"))
+			if ok != wantOK || (err != nil) != wantErr {
+				t.Errorf("%s, encrypted %v: verified %v with error %v", what, keys != nil, ok, err)
+			}
+		}
+		for _, key := range []string{"intact", "flipped", "cut", "missing"} {
+			if _, err := cache(lru, key, content(1000), false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check("intact", "intact", true, false)
+
+		path := lru.Peek("flipped", "bkt").LocalFname
+		data, _ := ioutil.ReadFile(path)
+		data[len(data)-1] ^= 1
+		ioutil.WriteFile(path, data, 0644)
+		check("a flipped byte", "flipped", false, false)
+		os.Truncate(lru.Peek("cut", "bkt").LocalFname, 500)
+		check("cut short", "cut", false, false)
+
+		//a file that can't be read may still be fine
+		os.Remove(lru.Peek("missing", "bkt").LocalFname)
+		check("unreadable", "missing", false, true)
+	}
+}
@@ -1,47 +1,25 @@
 package queues
 
-import (
-	"errors"
-	"io"
-	"os"
-)
+import "bytes"
 
-//MemFile for in mem cached files
+//MemFile for in mem cached files.  The content never changes once cached and is shared by
+//every request, each of which reads it through its own Reader
 type MemFile struct {
-	offset    int64
-	dirOffset int
-	Content   []byte
+	content []byte
 }
 
-func (f *MemFile) Read(p []byte) (n int, err error) {
-	if len(f.Content)-int(f.offset) >= len(p) {
-		n = len(p)
-	} else {
-		n = len(f.Content) - int(f.offset)
-		err = io.EOF
-	}
-	copy(p, f.Content[f.offset:f.offset+int64(n)])
-	f.offset += int64(n)
-	return
+//NewMemFile wraps data, which the caller must not modify afterwards
+func NewMemFile(data []byte) *MemFile {
+	return &MemFile{content: data}
 }
 
-var errWhence = errors.New("Seek: invalid whence")
-var errOffset = errors.New("Seek: invalid offset")
+//Reader returns a new reader over the content, positioned at the start.  It is an
+//io.ReadSeeker as ServeContent needs for Range requests, and copies nothing
+func (f *MemFile) Reader() *bytes.Reader {
+	return bytes.NewReader(f.content)
+}
 
-//Seek exported for ServeContent call
-func (f *MemFile) Seek(offset int64, whence int) (ret int64, err error) {
-	switch whence {
-	default:
-		return 0, errWhence
-	case os.SEEK_SET:
-	case os.SEEK_CUR:
-		offset += f.offset
-	case os.SEEK_END:
-		offset += int64(len(f.Content))
-	}
-	if offset < 0 || int(offset) > len(f.Content) {
-		return 0, errOffset
-	}
-	f.offset = offset
-	return f.offset, nil
+//Len is the size of the content
+func (f *MemFile) Len() int64 {
+	return int64(len(f.content))
 }
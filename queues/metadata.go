@@ -0,0 +1,283 @@
+package queues
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//UserMetaPrefix is the header prefix S3 uses for user defined metadata
+const UserMetaPrefix = "x-amz-meta-"
+
+//metaDir holds the sidecar files in each cache directory.  S3 bucket names can't start with
+//a '.', and requests for ones that do are rejected, so it can never collide with a cached bucket
+const metaDir = ".meta"
+
+//Metadata is the object metadata S3 returns alongside an object's content
+type Metadata struct {
+	ContentType        string            `json:"ContentType,omitempty"`
+	ContentEncoding    string            `json:"ContentEncoding,omitempty"`
+	ContentDisposition string            `json:"ContentDisposition,omitempty"`
+	ContentLanguage    string            `json:"ContentLanguage,omitempty"`
+	CacheControl       string            `json:"CacheControl,omitempty"`
+	Expires            string            `json:"Expires,omitempty"`
+	ETag               string            `json:"ETag,omitempty"`
+	LastModified       time.Time         `json:"LastModified"`
+	UserMeta           map[string]string `json:"UserMeta,omitempty"` //keys are lower case, without the x-amz-meta- prefix
+}
+
+//MetadataFromHeader collects the object metadata a client sent with a PUT
+func MetadataFromHeader(h http.Header) *Metadata {
+	meta := &Metadata{
+		ContentType:        h.Get("Content-Type"),
+		ContentEncoding:    h.Get("Content-Encoding"),
+		ContentDisposition: h.Get("Content-Disposition"),
+		ContentLanguage:    h.Get("Content-Language"),
+		CacheControl:       h.Get("Cache-Control"),
+		Expires:            h.Get("Expires"),
+		LastModified:       time.Now().UTC(),
+		UserMeta:           make(map[string]string),
+	}
+	for k := range h {
+		lower := strings.ToLower(k)
+		if strings.HasPrefix(lower, UserMetaPrefix) {
+			meta.UserMeta[strings.TrimPrefix(lower, UserMetaPrefix)] = h.Get(k)
+		}
+	}
+	return meta
+}
+
+//WriteHeader sets the response headers for the object.  Last-Modified is left to
+//http.ServeContent, which also handles conditional requests with it
+func (m *Metadata) WriteHeader(h http.Header) {
+	if m == nil {
+		return
+	}
+	set := func(k string, v string) {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+	set("Content-Type", m.ContentType)
+	set("Content-Encoding", m.ContentEncoding)
+	set("Content-Disposition", m.ContentDisposition)
+	set("Content-Language", m.ContentLanguage)
+	set("Cache-Control", m.CacheControl)
+	set("Expires", m.Expires)
+	set("ETag", m.ETag)
+	for k, v := range m.UserMeta {
+		h[UserMetaPrefix+k] = []string{v}
+	}
+}
+
+func metaPath(d *cacheDir, bucket string, fkey string) string {
+	return d.path + metaDir + "/" + bucket + "/" + fkey + ".json"
+}
+
+//sidecar is what's persisted of a node next to its file, so the queue can be rebuilt on a
+//restart.  Older sidecars held only the Metadata and are dropped by Restore
+type sidecar struct {
+	Meta       *Metadata
+	LocalFname string
+	Size       int64
+	Length     int64
+	Encoding   string `json:",omitempty"`
+	Checksum   string `json:",omitempty"`
+	Pinned     bool   `json:",omitempty"`
+	Added      time.Time
+}
+
+//persist writes a node's sidecar so it survives a restart.  It's written outside the locks
+//and renamed into place under the shard lock if the node is still queued as it was, so a node
+//dropped or changed meanwhile doesn't get a stale one.  Copies of a node made when it changes
+//tier keep its LocalFname and Added
+func (lru *Queue) persist(n *Node) {
+	key := n.Bucket + "/" + n.Fkey
+	s := lru.shardFor(n.Bucket, n.Fkey)
+	current := func() *Node {
+		if node, ok := s.index[key]; ok && node.LocalFname == n.LocalFname && node.Added.Equal(n.Added) {
+			return node
+		}
+		return nil
+	}
+	s.mutex.Lock()
+	node := current()
+	var sc sidecar
+	if node != nil {
+		sc = sidecar{Meta: node.Meta, LocalFname: node.LocalFname, Size: node.size, Length: node.Length,
+			Encoding: node.Encoding, Checksum: node.Checksum, Pinned: node.Pinned, Added: node.Added}
+	}
+	s.mutex.Unlock()
+	if node == nil {
+		return
+	}
+
+	path := metaPath(n.dir, n.Bucket, n.Fkey)
+	data, err := json.Marshal(&sc)
+	var file *os.File
+	if err == nil {
+		file, err = TempFile(path)
+	}
+	if err == nil {
+		_, err = file.Write(data)
+		if errC := file.Close(); err == nil {
+			err = errC
+		}
+		s.mutex.Lock()
+		//a Pin since the snapshot persists the newer state itself
+		if err == nil && current() != nil && current().Pinned == sc.Pinned {
+			err = os.Rename(file.Name(), path)
+		}
+		s.mutex.Unlock()
+		os.Remove(file.Name())
+	}
+	if err != nil {
+		log.Errorln("Could not persist metadata", key, err)
+	}
+}
+
+//Restore rebuilds the queue from the sidecars a previous run left, oldest first, and returns
+//how many objects it queued.  An object whose file is gone, has changed size or can't be read
+//with the current Dedup and EncryptionKeys settings is dropped.  It runs before anything else
+//is cached
+func (lru *Queue) Restore() int {
+	masters := lru.args.MasterKeys()
+	var nodes []*Node
+	dropped := 0
+	for _, d := range lru.dirs {
+		root := d.path + metaDir + "/"
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.Mode().IsRegular() == false || strings.HasSuffix(path, ".json") == false {
+				return nil
+			}
+			parts := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(path, root), ".json"), "/", 2)
+			if len(parts) != 2 {
+				return nil
+			}
+			node, why := lru.restoreNode(d, parts[0], parts[1], path, masters)
+			if node == nil {
+				log.Debugln("Dropping cached object", parts[0], parts[1], why)
+				os.Remove(path)
+				dropped++
+				return nil
+			}
+			nodes = append(nodes, node)
+			return nil
+		})
+	}
+
+	//queued oldest first, so the least recently added are evicted first
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Added.Before(nodes[j].Added) })
+	restored := 0
+	for _, node := range nodes {
+		lru.hold(node)
+		if _, err := lru.add(node); err != nil {
+			log.Warnln("Could not restore cached object", node.Bucket, node.Fkey, err)
+			lru.Discard(node.Bucket, node.Fkey, node.LocalFname)
+			dropped++
+			continue
+		}
+		lru.persist(node)
+		restored++
+	}
+	log.Infoln("Restored", restored, "cached objects, dropped", dropped)
+	return restored
+}
+
+//hold counts a file that's already in place pending, as Store does, so it can be Added
+func (lru *Queue) hold(n *Node) {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	name := filepath.Base(n.LocalFname)
+	if b, ok := lru.blobs[name]; ok && b.path == n.LocalFname {
+		b.pending++
+		return
+	} else if ok == false && lru.args.Dedup == true && strings.HasPrefix(n.LocalFname, n.dir.path+blobDir+"/") {
+		lru.blobs[name] = &blob{name: name, path: n.LocalFname, dir: n.dir, pending: 1}
+		return
+	}
+	s := lru.shardFor(n.Bucket, n.Fkey)
+	s.mutex.Lock()
+	s.pending[n.LocalFname]++
+	s.mutex.Unlock()
+}
+
+//Requeue queues the file of an upload a previous run didn't finish, unless Restore queued it
+//already.  If it can't be queued the file is still held, and must be given back with Discard
+//once the upload is done with it
+func (lru *Queue) Requeue(bucket string, fkey string, localFname string, meta *Metadata, checksum string, encoding string, length int64) error {
+	s := lru.shardFor(bucket, fkey)
+	s.mutex.Lock()
+	node, queued := s.index[bucket+"/"+fkey]
+	s.mutex.Unlock()
+	if queued == true && node.LocalFname == localFname {
+		return nil
+	}
+	d := lru.dirOf(localFname)
+	if d == nil {
+		return ErrNoDir
+	}
+	info, err := os.Stat(localFname)
+	if err != nil {
+		return err
+	}
+	node = &Node{Bucket: bucket, Fkey: fkey, LocalFname: localFname, dir: d, size: info.Size(), Length: length,
+		Encoding: encoding, Meta: meta, Checksum: checksum, Added: time.Now(), ModTime: meta.LastModified}
+	lru.hold(node)
+	if _, err = lru.add(node); err != nil {
+		return err
+	}
+	lru.persist(node)
+	return nil
+}
+
+//restoreNode reads a sidecar back into a node, or returns why it can't be used
+func (lru *Queue) restoreNode(d *cacheDir, bucket string, fkey string, path string, masters [][]byte) (*Node, string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err.Error()
+	}
+	var sc sidecar
+	errJ := json.Unmarshal(data, &sc)
+	//a file under the object's own name isn't shared, drop it along with the sidecar
+	drop := func(why string) (*Node, string) {
+		if sc.LocalFname == "" || sc.LocalFname == d.path+bucket+"/"+fkey {
+			os.Remove(d.path + bucket + "/" + fkey)
+		}
+		return nil, why
+	}
+	if errJ != nil || sc.LocalFname == "" {
+		return drop("sidecar is from an older version")
+	}
+	blobPath := strings.HasPrefix(sc.LocalFname, d.path+blobDir+"/")
+	if lru.dirOf(sc.LocalFname) != d || blobPath == true && lru.args.Dedup == false {
+		return drop("file is somewhere the current settings don't put it")
+	}
+	info, err := os.Stat(sc.LocalFname)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if info.Size() != sc.Size {
+		return drop("file has changed size")
+	}
+	if sealedFor(sc.LocalFname, masters) == false {
+		return drop("file isn't encrypted with the current EncryptionKeys")
+	}
+	if sc.Meta == nil {
+		sc.Meta = &Metadata{}
+	}
+	return &Node{Bucket: bucket, Fkey: fkey, LocalFname: sc.LocalFname, dir: d, size: sc.Size, Length: sc.Length,
+		Encoding: sc.Encoding, Meta: sc.Meta, Checksum: sc.Checksum, Pinned: sc.Pinned, Added: sc.Added,
+		ModTime: sc.Meta.LastModified}, ""
+}
+
+func removeMetadata(d *cacheDir, bucket string, fkey string) {
+	os.Remove(metaPath(d, bucket, fkey))
+}
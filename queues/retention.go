@@ -0,0 +1,193 @@
+package queues
+
+import (
+	"errors"
+	"s3envoy/loadArgs"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//ErrPinnedFull is returned by Add and Pin when pinned objects would take more than the
+//capacity of their cache directory
+var ErrPinnedFull = errors.New("pinned objects would exceed the cache capacity")
+
+//ErrShareFull is returned by Add when an object's retention rule has used its share of the
+//cache and everything in it is pinned
+var ErrShareFull = errors.New("the retention rule's share of the cache is full of pinned objects")
+
+//ErrRulePinned is returned by Pin for an object a retention rule pins
+var ErrRulePinned = errors.New("pinned by a retention rule")
+
+//rule is a RetentionRule and what its objects take.  The counts are guarded by spaceMutex
+type rule struct {
+	loadArgs.RetentionRule
+	files int
+	disk  int64
+	mem   int64
+}
+
+//RuleStats is the space the objects of a retention rule take, and what they may take
+type RuleStats struct {
+	Bucket    string
+	Prefix    string
+	Files     int
+	DiskUsed  int64
+	DiskLimit int64 //0 for no limit
+	MemUsed   int64
+	MemLimit  int64
+}
+
+//newRules orders the configured rules most specific first, so the first match applies
+func newRules(args *loadArgs.Args) []*rule {
+	var rules []*rule
+	for _, r := range args.Retention {
+		rules = append(rules, &rule{RetentionRule: r})
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if (rules[i].Bucket == "") != (rules[j].Bucket == "") {
+			return rules[i].Bucket != ""
+		}
+		return len(rules[i].Prefix) > len(rules[j].Prefix)
+	})
+	return rules
+}
+
+//priorities are the distinct rule priorities and the default 0, lowest first
+func priorities(rules []*rule) []int {
+	seen := map[int]bool{0: true}
+	list := []int{0}
+	for _, r := range rules {
+		if seen[r.Priority] == false {
+			seen[r.Priority] = true
+			list = append(list, r.Priority)
+		}
+	}
+	sort.Ints(list)
+	return list
+}
+
+//ruleFor is the retention rule of an object, nil if none matches
+func (lru *Queue) ruleFor(bucket string, fkey string) *rule {
+	for _, r := range lru.rules {
+		if (r.Bucket == "" || r.Bucket == bucket) && strings.HasPrefix(fkey, r.Prefix) {
+			return r
+		}
+	}
+	return nil
+}
+
+func priority(n *Node) int {
+	if n.rule == nil {
+		return 0
+	}
+	return n.rule.Priority
+}
+
+//expired is true for a node older than its rule's MaxAge
+func expired(n *Node) bool {
+	return n.rule != nil && n.rule.MaxAge > 0 && time.Since(n.Added) > n.rule.MaxAge
+}
+
+//diskLimit and memLimit are a rule's share of the capacity, 0 for no limit.  The caller
+//holds spaceMutex
+func (lru *Queue) diskLimit(r *rule) int64 {
+	if r == nil || r.MaxDiskPercent == 0 {
+		return 0
+	}
+	_, capacity := lru.disk()
+	return capacity * int64(r.MaxDiskPercent) / 100
+}
+
+func (lru *Queue) memLimit(r *rule) int64 {
+	if r == nil || r.MaxMemPercent == 0 {
+		return 0
+	}
+	return lru.memCap * int64(r.MaxMemPercent) / 100
+}
+
+//fitDiskShare evicts the least recently used objects of n's rule until n fits in the rule's
+//share of DiskCap.  It returns false if only pinned ones are left.  The caller holds spaceMutex
+func (lru *Queue) fitDiskShare(n *Node) bool {
+	limit := lru.diskLimit(n.rule)
+	for limit > 0 && n.rule.disk+n.size > limit {
+		if lru.evictFrom(func(o *Node) bool { return o.rule == n.rule }) == false {
+			return false
+		}
+	}
+	return true
+}
+
+//fitMemShare demotes the least recently used objects of n's rule until n fits in the rule's
+//share of MemCap.  It returns false if that's impossible.  The caller holds spaceMutex
+func (lru *Queue) fitMemShare(n *Node) bool {
+	limit := lru.memLimit(n.rule)
+	if limit > 0 && n.size > limit {
+		return false
+	}
+	for limit > 0 && n.rule.mem+n.size > limit {
+		if lru.demoteFrom(func(o *Node) bool { return o.rule == n.rule }) == false {
+			return false
+		}
+	}
+	return true
+}
+
+//Expire drops the objects older than their retention rule's MaxAge, pinned ones too, and
+//returns how many it dropped.  Retrieve already treats them as missing
+func (lru *Queue) Expire() int {
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	dropped := 0
+	for _, s := range lru.shards {
+		var nodes []*Node
+		s.mutex.Lock()
+		for _, node := range s.index {
+			if expired(node) == true {
+				s.unlink(node)
+				lru.removeFiles(node)
+				nodes = append(nodes, node)
+			}
+		}
+		s.mutex.Unlock()
+		for _, node := range nodes {
+			lru.release(node)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Infoln("Expired", dropped, "objects past their retention MaxAge")
+	}
+	return dropped
+}
+
+//ExpireInterval is how often Expire should run for the shortest MaxAge to be kept to within
+//a tenth, between a second and a minute.  0 if no rule has a MaxAge
+func (lru *Queue) ExpireInterval() time.Duration {
+	var interval time.Duration
+	for _, r := range lru.rules {
+		if r.MaxAge > 0 && (interval == 0 || r.MaxAge/10 < interval) {
+			interval = r.MaxAge / 10
+		}
+	}
+	if interval == 0 {
+		return 0
+	} else if interval < time.Second {
+		return time.Second
+	} else if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
+
+//ruleStats of every retention rule.  The caller holds spaceMutex
+func (lru *Queue) ruleStats() []RuleStats {
+	var stats []RuleStats
+	for _, r := range lru.rules {
+		stats = append(stats, RuleStats{Bucket: r.Bucket, Prefix: r.Prefix, Files: r.files, DiskUsed: r.disk,
+			DiskLimit: lru.diskLimit(r), MemUsed: r.mem, MemLimit: lru.memLimit(r)})
+	}
+	return stats
+}
@@ -0,0 +1,117 @@
+package queues
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestPinnedLimits(t *testing.T) {
+	lru := newTestQueue(t, map[string]interface{}{"DiskCap": "2000B", "PromoteAfter": 0,
+		"Retention": []map[string]interface{}{{"Bucket": "bkt", "Prefix": "keep/", "Pinned": "True"}}})
+	defer os.RemoveAll(lru.args.LocalPath)
+
+	//a rule's pinned objects can't be unpinned
+	if _, err := cache(lru, "keep/a", content(1200), false); err != nil {
+		t.Fatal(err)
+	}
+	if node := lru.Peek("keep/a", "bkt"); node.Pinned == false {
+		t.Fatal("keep/a isn't pinned by its rule")
+	}
+	if _, err := lru.Pin("keep/a", "bkt", false); err != ErrRulePinned {
+		t.Fatalf("unpinning keep/a: expected %v, got %v", ErrRulePinned, err)
+	}
+
+	//nothing can be evicted to make room next to it
+	if _, err := cache(lru, "b", content(900), false); err != ErrPinnedFull {
+		t.Fatalf("adding past the pinned objects: expected %v, got %v", ErrPinnedFull, err)
+	}
+	if _, err := cache(lru, "b", content(700), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lru.Pin("b", "bkt", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache(lru, "c", content(200), false); err != ErrPinnedFull {
+		t.Fatalf("adding with everything pinned: expected %v, got %v", ErrPinnedFull, err)
+	}
+	if _, err := lru.Pin("b", "bkt", false); err != nil {
+		t.Fatal(err)
+	}
+
+	//shrinking the cache leaves less room to pin
+	lru.Resize(lru.memCap, 1500)
+	if _, err := cache(lru, "b", content(200), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lru.Pin("b", "bkt", true); err != nil {
+		t.Fatal(err)
+	}
+	lru.Resize(lru.memCap, 1300)
+	if _, err := lru.Pin("b", "bkt", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lru.Pin("b", "bkt", true); err != ErrPinnedFull {
+		t.Fatalf("pinning past the capacity: expected %v, got %v", ErrPinnedFull, err)
+	}
+	if pinned := lru.Stats().PinnedBytes; pinned != 1200 {
+		t.Fatalf("%d bytes pinned, expected 1200", pinned)
+	}
+	checkQueue(t, lru)
+}
+
+func TestShareLimits(t *testing.T) {
+	lru := newTestQueue(t, map[string]interface{}{"DiskCap": "8000B", "MemCap": "2000B", "MaxMemFileSize": "1000B",
+		"PromoteAfter": 0, "Retention": []map[string]interface{}{
+			{"Bucket": "bkt", "Prefix": "share/", "MaxDiskPercent": 25},
+			{"Bucket": "bkt", "Prefix": "mem/", "MaxMemPercent": 50}}})
+	defer os.RemoveAll(lru.args.LocalPath)
+	cached := func(keys ...string) {
+		for _, key := range keys {
+			if lru.Peek(key, "bkt") == nil {
+				t.Fatalf("%s was evicted", key)
+			}
+		}
+	}
+
+	//the rule's objects make room among themselves, in a cache with room for more
+	for _, key := range []string{"other/1", "share/1", "share/2", "other/2", "share/3"} {
+		if _, err := cache(lru, key, content(900), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached("other/1", "other/2", "share/2", "share/3")
+	if lru.Peek("share/1", "bkt") != nil {
+		t.Fatal("share/1 wasn't evicted for share/3")
+	}
+	for _, r := range lru.Stats().Rules {
+		if r.Prefix == "share/" && (r.Files != 2 || r.DiskUsed != 1800 || r.DiskLimit != 2000) {
+			t.Fatalf("the share rule has %d files taking %d of %d bytes", r.Files, r.DiskUsed, r.DiskLimit)
+		}
+	}
+
+	//and can't once their share is pinned
+	lru.Pin("share/2", "bkt", true)
+	lru.Pin("share/3", "bkt", true)
+	if _, err := cache(lru, "share/4", content(900), false); err != ErrShareFull {
+		t.Fatalf("adding to a pinned share: expected %v, got %v", ErrShareFull, err)
+	}
+	cached("other/1", "other/2", "share/2", "share/3")
+	checkQueue(t, lru)
+
+	//in memory the rule's own objects are demoted first
+	if _, err := cache(lru, "other/m", content(800), true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cache(lru, fmt.Sprintf("mem/%d", i), content(400), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, inmem := range map[string]bool{"other/m": true, "mem/0": false, "mem/1": true, "mem/2": true} {
+		if node := lru.Peek(key, "bkt"); node.Inmem != inmem {
+			t.Fatalf("%s in memory is %v, expected %v", key, node.Inmem, inmem)
+		}
+	}
+	checkQueue(t, lru)
+}
@@ -0,0 +1,96 @@
+package queues
+
+import (
+	"sync"
+	"time"
+)
+
+//shard is one stripe of the queue: an index of its keys and their own LRU list
+type shard struct {
+	mutex sync.Mutex
+	index map[string]*Node //bucket+"/"+fkey to node
+	//pending counts the plain cache files of the shard's keys that were Stored but not yet
+	//Added or Discarded, by path.  removeFiles leaves those alone
+	pending map[string]int
+	head    *Node
+	tail    *Node
+}
+
+func newShard() *shard {
+	return &shard{index: make(map[string]*Node), pending: make(map[string]int)}
+}
+
+//moveToHead marks a node as just used, queueing it if it isn't already
+func (s *shard) moveToHead(move *Node) {
+	move.lastUsed = time.Now()
+	//add new node to head of queue and shift current head down 1
+	if s.head == move {
+		return
+	}
+
+	//if node is already queued take it out of its current position first
+	if move.prev != nil {
+		move.prev.next = move.next
+		if move.next != nil {
+			move.next.prev = move.prev
+		} else {
+			s.tail = move.prev
+		}
+	}
+	oldH := s.head
+	move.prev = nil
+	move.next = oldH
+	if oldH != nil {
+		oldH.prev = move
+	}
+	s.head = move
+	if s.tail == nil {
+		s.tail = move
+	}
+}
+
+//unlink takes a node out of the list and the index
+func (s *shard) unlink(n *Node) {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		s.head = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		s.tail = n.prev
+	}
+	n.prev = nil
+	n.next = nil
+	delete(s.index, n.Bucket+"/"+n.Fkey)
+}
+
+//replace puts n in old's place in the list and the index, used when an object changes tier
+func (s *shard) replace(old *Node, n *Node) {
+	n.prev = old.prev
+	n.next = old.next
+	if n.prev != nil {
+		n.prev.next = n
+	} else {
+		s.head = n
+	}
+	if n.next != nil {
+		n.next.prev = n
+	} else {
+		s.tail = n
+	}
+	old.prev = nil
+	old.next = nil
+	s.index[n.Bucket+"/"+n.Fkey] = n
+}
+
+//leastRecent is the least recently used node match accepts, if any
+func (s *shard) leastRecent(match func(*Node) bool) *Node {
+	for tmp := s.tail; tmp != nil; tmp = tmp.prev {
+		if match(tmp) == true {
+			return tmp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package queues
+
+import "syscall"
+
+//fsUsage is how full the filesystem holding path is, in percent, and the bytes it has in use
+//out of its total.  Like df it counts the blocks reserved for root as unavailable
+func fsUsage(path string) (int, int64, int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, 0, err
+	}
+	used := int64(st.Blocks-st.Bfree) * int64(st.Bsize)
+	total := used + int64(st.Bavail)*int64(st.Bsize)
+	return percent(used, total), used, total, nil
+}
+
+//percent is how much of total used is, rounded up
+func percent(used int64, total int64) int {
+	if total <= 0 {
+		return 0
+	}
+	return int((used*100 + total - 1) / total)
+}
@@ -0,0 +1,86 @@
+package queues
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//tempPrefix starts the name of a cache file still being written.  Readers only ever see
+//the final name, which the file gets once it's complete
+const tempPrefix = ".s3envoy-tmp-"
+
+//TempFile creates the file an object is written to before it becomes localFname, in the
+//same directory so the rename can't cross filesystems
+func TempFile(localFname string) (*os.File, error) {
+	dir := filepath.Dir(localFname)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, tempPrefix)
+}
+
+//Commit renames a complete TempFile into place, replacing any older copy in one step.  With
+//sync the content and then the directory entry are flushed to disk so a crash can't leave
+//a truncated file under the final name.  The file is left open
+func Commit(file *os.File, localFname string, sync bool) error {
+	if sync == true {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(file.Name(), localFname); err != nil {
+		return err
+	}
+	if sync == true {
+		return syncDir(localFname)
+	}
+	return nil
+}
+
+//syncDir flushes the directory entry of a renamed file
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+//CleanTemp removes the temp files writes interrupted by a crash left in the cache directories,
+//and the Dedup blobs nothing refers to.  It runs after Restore and the resumed uploads have
+//claimed the blobs they use
+func (lru *Queue) CleanTemp() {
+	for _, d := range lru.dirs {
+		removed := 0
+		filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.Mode().IsRegular() == false {
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), tempPrefix) == true || lru.unclaimedBlob(d, path) == true {
+				if os.Remove(path) == nil {
+					removed++
+				}
+			}
+			return nil
+		})
+		if removed > 0 {
+			log.Infoln("Removed", removed, "unfinished or unused cache files from", d.path)
+		}
+	}
+}
+
+//unclaimedBlob is true for a file under the blob directory that isn't a known blob
+func (lru *Queue) unclaimedBlob(d *cacheDir, path string) bool {
+	if strings.HasPrefix(path, d.path+blobDir+"/") == false {
+		return false
+	}
+	lru.spaceMutex.Lock()
+	defer lru.spaceMutex.Unlock()
+	b, ok := lru.blobs[filepath.Base(path)]
+	return ok == false || b.path != path
+}
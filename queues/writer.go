@@ -0,0 +1,131 @@
+package queues
+
+import (
+	"io"
+	"os"
+)
+
+//Writer caches an object's content as it streams in.  It's compressed with the encoding
+//asked for, then encrypted when EncryptionKeys are set, on its way into a TempFile, so the
+//content never reaches the cache directories as it was received
+type Writer struct {
+	lru        *Queue
+	file       *os.File
+	localFname string
+	encoding   string
+	pipe       io.Writer
+	enc        io.WriteCloser //the compressor, nil for none
+	seal       *sealer        //nil without EncryptionKeys
+	length     int64          //content written
+	stored     counter        //bytes the compressor wrote, before sealing
+}
+
+//counter counts the bytes on their way to w
+type counter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+//NewWriter creates the TempFile for an object that will be localFname, compressed with
+//encoding if it isn't ""
+func (lru *Queue) NewWriter(localFname string, encoding string) (*Writer, error) {
+	file, err := TempFile(localFname)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{lru: lru, file: file, localFname: localFname, encoding: encoding}
+	var out io.Writer = file
+	if masters := lru.args.MasterKeys(); len(masters) > 0 {
+		if w.seal, err = newSealer(file, masters[0]); err != nil {
+			w.Abort()
+			return nil, err
+		}
+		out = w.seal
+	}
+	w.stored.w = out
+	w.pipe = &w.stored
+	if encoding != "" {
+		if w.enc, err = newEncoder(&w.stored, encoding); err != nil {
+			w.Abort()
+			return nil, err
+		}
+		w.pipe = w.enc
+	}
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.pipe.Write(p)
+	w.length += int64(n)
+	return n, err
+}
+
+//Finish completes the file and returns it positioned at the start, with the encoding and size
+//actually stored.  Content that didn't get any smaller is rewritten as it is, with encoding "".
+//If it fails the file is removed
+func (w *Writer) Finish() (*os.File, string, int64, error) {
+	err := w.close()
+	if err == nil && w.encoding != "" && w.stored.n >= w.length {
+		return w.uncompressed()
+	}
+	var size int64
+	if err == nil {
+		size, err = w.file.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = w.file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		w.Abort()
+		return nil, "", 0, err
+	}
+	return w.file, w.encoding, size, nil
+}
+
+func (w *Writer) close() error {
+	if w.enc != nil {
+		if err := w.enc.Close(); err != nil {
+			return err
+		}
+	}
+	if w.seal != nil {
+		return w.seal.Close()
+	}
+	return nil
+}
+
+//uncompressed rewrites a finished file without its compression, decompressing and decrypting
+//it as it's read so the content is still only ever written encrypted
+func (w *Writer) uncompressed() (*os.File, string, int64, error) {
+	defer w.Abort()
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return nil, "", 0, err
+	}
+	stored, err := w.lru.Unseal(w.file)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	plain, err := w.lru.NewWriter(w.localFname, "")
+	if err != nil {
+		return nil, "", 0, err
+	}
+	content := Decode(stored, w.encoding, w.length)
+	defer content.Close()
+	if _, err = io.Copy(plain, content); err != nil {
+		plain.Abort()
+		return nil, "", 0, err
+	}
+	return plain.Finish()
+}
+
+//Abort closes and removes the file of an object that won't be cached
+func (w *Writer) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
@@ -0,0 +1,98 @@
+package queues
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//plainOnDisk is true if a file in the queue's cache dir holds part of plain
+func plainOnDisk(t *testing.T, lru *Queue, plain []byte) bool {
+	found := false
+	filepath.Walk(lru.args.LocalPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode().IsRegular() == false || filepath.Base(path) == "config.json" {
+			return nil
+		}
+		data, _ := ioutil.ReadFile(path)
+		for i := 0; i+32 <= len(plain); i += len(plain)/8 + 1 {
+			found = found || bytes.Contains(data, plain[i:i+32])
+		}
+		return nil
+	})
+	return found
+}
+
+func TestWriter(t *testing.T) {
+	text := bytes.Repeat([]byte("the same few words, over and over again. "), 5000)
+	cases := []struct {
+		name     string
+		content  []byte
+		encoding string
+		stored   string //the encoding it's expected to be stored with
+	}{
+		{"plain", content(3*chunkSize + 100), "", ""},
+		{"compressed", text, "gzip", "gzip"},
+		{"compressed with zstd", text, "zstd", "zstd"},
+		{"incompressible", content(2*chunkSize + 7), "gzip", ""},
+		{"empty", nil, "zstd", ""},
+	}
+	for _, sealed := range []bool{false, true} {
+		for _, c := range cases {
+			var keys [][]byte
+			if sealed == true {
+				keys = append(keys, newKey(t))
+			}
+			lru := newSealQueue(t, keys...)
+			defer os.RemoveAll(lru.args.LocalPath)
+			localFname := lru.args.LocalPath + "bkt/" + c.name
+			w, err := lru.NewWriter(localFname, c.encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			//in pieces, so anything spilled to disk on the way would be seen
+			for rest := c.content; len(rest) > 0; {
+				n := len(rest)
+				if n > chunkSize/3 {
+					n = chunkSize / 3
+				}
+				if _, err = w.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+				if sealed == true && plainOnDisk(t, lru, c.content) == true {
+					t.Fatalf("%s: plaintext in the cache dir while writing", c.name)
+				}
+			}
+			file, encoding, size, err := w.Finish()
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if encoding != c.stored {
+				t.Errorf("%s: stored with encoding %q, expected %q", c.name, encoding, c.stored)
+			}
+			if info, _ := file.Stat(); info.Size() != size {
+				t.Errorf("%s: %d bytes stored, %d reported", c.name, info.Size(), size)
+			}
+			if err = Commit(file, localFname, false); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+			if sealed == true && plainOnDisk(t, lru, c.content) == true {
+				t.Fatalf("%s: plaintext in the cache dir", c.name)
+			}
+			if names, _ := filepath.Glob(lru.args.LocalPath + "bkt/" + tempPrefix + "*"); len(names) > 0 {
+				t.Errorf("%s: temp files left behind: %v", c.name, names)
+			}
+			stored, err := lru.ReadStored(localFname)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			read, err := ioutil.ReadAll(Decode(bytes.NewReader(stored), encoding, int64(len(c.content))))
+			if err != nil || bytes.Equal(read, c.content) == false {
+				t.Fatalf("%s: read back %d bytes of %d, error %v", c.name, len(read), len(c.content), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"s3envoy/loadArgs"
+	"s3envoy/policy"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pivotal-golang/bytefmt"
+)
+
+const usage = `usage: s3envoyctl [-node host:port] [-token token] [-o table|json] <command> [args]
+
+commands:
+  cluster                          cluster membership and each node's cache stats
+  stats                            cache stats of the node
+  ls [bucket [prefix]]             cached objects
+  purge [-prefix] [-cluster] bucket key
+                                   drop a key, or everything under a prefix, from the cache
+  warm [-f file] bucket [key...]   fetch keys into the cache, one per line from -f ("-" for stdin)
+  drain                            stop advertising the node's objects to peers
+  uploads                          background uploads still pending
+  validate config.json             check a config file
+`
+
+var node = flag.String("node", "127.0.0.1:7081", "admin API address of an s3envoy node")
+var output = flag.String("o", "table", "output format, table or json")
+var token = flag.String("token", os.Getenv("S3ENVOY_ADMINTOKEN"), "admin API token, if the nodes have an AdminToken")
+var client = &http.Client{Timeout: 30 * time.Second}
+
+//the admin API's responses, see s3proxy/admin.go
+type cacheEntry struct {
+	Bucket     string
+	Key        string
+	Size       int64
+	Tier       string
+	Pinned     bool
+	Added      time.Time
+	AgeSeconds int64
+}
+
+type nodeStats struct {
+	Name           string
+	Cluster        bool
+	Files          int
+	MemFiles       int
+	Pinned         int
+	PinnedBytes    int64
+	MemUsed        int64
+	MemCap         int64
+	DiskUsed       int64
+	DiskCap        int64
+	Dirs           []dirStats
+	Blobs          int
+	DedupSaved     int64
+	Rules          []ruleStats
+	Draining       bool
+	PendingUploads int
+	GlobalHashSize int
+}
+
+type dirStats struct {
+	Path     string
+	Capacity int64
+	Used     int64
+	Files    int
+	Healthy  bool
+	FSUsed   int
+	Critical bool
+}
+
+type ruleStats struct {
+	Bucket    string
+	Prefix    string
+	Files     int
+	DiskUsed  int64
+	DiskLimit int64
+	MemUsed   int64
+	MemLimit  int64
+}
+
+type member struct {
+	Name  string
+	Addr  string
+	Alive bool
+}
+
+type purgeResult struct {
+	Bucket  string
+	Purged  []string
+	Cluster bool
+}
+
+type pendingUpload struct {
+	Bucket    string
+	Key       string
+	Size      int64
+	Started   time.Time
+	Attempts  int
+	LastError string
+}
+
+//call the admin API of addr and decode its JSON response into v
+func call(method string, addr string, path string, v interface{}) error {
+	req, err := http.NewRequest(method, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		apiErr := struct{ Error string }{}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return fmt.Errorf("%s %s: %s", method, path, apiErr.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+//escape a bucket and key for use in an admin API path
+func objectPath(bucket string, fkey string) string {
+	path := url.PathEscape(bucket) + "/"
+	for i, part := range strings.Split(fkey, "/") {
+		if i > 0 {
+			path += "/"
+		}
+		path += url.PathEscape(part)
+	}
+	return path
+}
+
+//show prints v as JSON, or as a table with the given header and rows
+func show(v interface{}, header string, rows func(w io.Writer)) {
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	rows(w)
+	w.Flush()
+}
+
+func size(n int64) string {
+	if n <= 0 {
+		return "0B"
+	}
+	return bytefmt.ByteSize(uint64(n))
+}
+
+//limited shows space used out of a limit, if there is one
+func limited(used int64, limit int64) string {
+	if limit == 0 {
+		return size(used)
+	}
+	return size(used) + "/" + size(limit)
+}
+
+func statsRow(w io.Writer, s *nodeStats) {
+	fmt.Fprintf(w, "%s\t%d\t%d\t%s/%s\t%s/%s\t%d\t%t\n", s.Name, s.Files, s.Pinned,
+		size(s.MemUsed), size(s.MemCap), size(s.DiskUsed), size(s.DiskCap), s.PendingUploads, s.Draining)
+}
+
+const statsHeader = "NODE\tFILES\tPINNED\tMEM\tDISK\tUPLOADS\tDRAINING"
+
+func stats() error {
+	s := new(nodeStats)
+	if err := call("GET", *node, "/stats", s); err != nil {
+		return err
+	}
+	show(s, statsHeader, func(w io.Writer) {
+		statsRow(w, s)
+		if s.Blobs > 0 {
+			fmt.Fprintf(w, "\n%d distinct contents, dedup saves %s\n", s.Blobs, size(s.DedupSaved))
+		}
+		if s.PinnedBytes > 0 {
+			fmt.Fprintf(w, "\npinned objects take %s\n", size(s.PinnedBytes))
+		}
+		if len(s.Rules) > 0 {
+			fmt.Fprintln(w, "\nBUCKET\tPREFIX\tFILES\tDISK\tMEM")
+			for _, r := range s.Rules {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", r.Bucket, r.Prefix, r.Files,
+					limited(r.DiskUsed, r.DiskLimit), limited(r.MemUsed, r.MemLimit))
+			}
+		}
+		if len(s.Dirs) > 1 {
+			fmt.Fprintln(w, "\nCACHE DIR\tFILES\tUSED\tFS USED\tHEALTHY\tCRITICAL")
+			for _, d := range s.Dirs {
+				fmt.Fprintf(w, "%s\t%d\t%s/%s\t%d%%\t%t\t%t\n", d.Path, d.Files, size(d.Used), size(d.Capacity),
+					d.FSUsed, d.Healthy, d.Critical)
+			}
+		}
+	})
+	return nil
+}
+
+//clusterStatus asks the node for the memberlist view, then each live member for its stats.
+//Every node is assumed to serve the admin API on the same port
+func clusterStatus() error {
+	var members []member
+	if err := call("GET", *node, "/members", &members); err != nil {
+		return err
+	}
+	_, port, err := net.SplitHostPort(*node)
+	if err != nil {
+		return err
+	}
+
+	type status struct {
+		member
+		Stats *nodeStats `json:",omitempty"`
+		Error string     `json:",omitempty"`
+	}
+	var all []status
+	for _, m := range members {
+		st := status{member: m}
+		if m.Alive == true {
+			s := new(nodeStats)
+			if errC := call("GET", net.JoinHostPort(m.Addr, port), "/stats", s); errC != nil {
+				st.Error = errC.Error()
+			} else {
+				st.Stats = s
+			}
+		}
+		all = append(all, st)
+	}
+	show(all, "MEMBER\tADDR\tALIVE\t"+statsHeader, func(w io.Writer) {
+		for _, st := range all {
+			fmt.Fprintf(w, "%s\t%s\t%t\t", st.Name, st.Addr, st.Alive)
+			if st.Stats != nil {
+				statsRow(w, st.Stats)
+			} else {
+				fmt.Fprintf(w, "%s\n", st.Error)
+			}
+		}
+	})
+	return nil
+}
+
+func list(args []string) error {
+	query := url.Values{}
+	if len(args) > 0 {
+		query.Set("bucket", args[0])
+	}
+	if len(args) > 1 {
+		query.Set("prefix", args[1])
+	}
+	var entries []cacheEntry
+	if err := call("GET", *node, "/cache?"+query.Encode(), &entries); err != nil {
+		return err
+	}
+	show(entries, "BUCKET\tKEY\tSIZE\tTIER\tPINNED\tAGE", func(w io.Writer) {
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\n", e.Bucket, e.Key, size(e.Size), e.Tier, e.Pinned,
+				time.Duration(e.AgeSeconds)*time.Second)
+		}
+	})
+	return nil
+}
+
+func purge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	prefix := flags.Bool("prefix", false, "purge every key starting with key")
+	cluster := flags.Bool("cluster", false, "have every peer purge too")
+	flags.Parse(args)
+	if flags.NArg() != 2 && !(*prefix && flags.NArg() == 1) {
+		return fmt.Errorf("purge needs a bucket and a key")
+	}
+	query := url.Values{}
+	query.Set("prefix", strconv.FormatBool(*prefix))
+	query.Set("cluster", strconv.FormatBool(*cluster))
+	res := new(purgeResult)
+	if err := call("DELETE", *node, "/cache/"+objectPath(flags.Arg(0), flags.Arg(1))+"?"+query.Encode(), res); err != nil {
+		return err
+	}
+	show(res, "BUCKET\tPURGED", func(w io.Writer) {
+		for _, fkey := range res.Purged {
+			fmt.Fprintf(w, "%s\t%s\n", res.Bucket, fkey)
+		}
+	})
+	return nil
+}
+
+func warm(args []string) error {
+	flags := flag.NewFlagSet("warm", flag.ExitOnError)
+	file := flags.String("f", "", "file with one key per line, - for stdin")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		return fmt.Errorf("warm needs a bucket")
+	}
+	bucket := flags.Arg(0)
+	keys := flags.Args()[1:]
+	if *file != "" {
+		in := os.Stdin
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				keys = append(keys, strings.TrimPrefix(line, "/"))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	type result struct {
+		Key   string
+		Entry *cacheEntry `json:",omitempty"`
+		Error string      `json:",omitempty"`
+	}
+	var results []result
+	failed := 0
+	for _, fkey := range keys {
+		res := result{Key: fkey}
+		e := new(cacheEntry)
+		if err := call("POST", *node, "/warm/"+objectPath(bucket, fkey), e); err != nil {
+			res.Error = err.Error()
+			failed++
+		} else {
+			res.Entry = e
+		}
+		results = append(results, res)
+	}
+	show(results, "KEY\tSIZE\tTIER\tERROR", func(w io.Writer) {
+		for _, res := range results {
+			if res.Entry != nil {
+				fmt.Fprintf(w, "%s\t%s\t%s\t\n", res.Key, size(res.Entry.Size), res.Entry.Tier)
+			} else {
+				fmt.Fprintf(w, "%s\t\t\t%s\n", res.Key, res.Error)
+			}
+		}
+	})
+	if failed > 0 {
+		return fmt.Errorf("%d of %d keys could not be warmed", failed, len(keys))
+	}
+	return nil
+}
+
+func drain() error {
+	s := new(nodeStats)
+	if err := call("POST", *node, "/drain", s); err != nil {
+		return err
+	}
+	show(s, statsHeader, func(w io.Writer) { statsRow(w, s) })
+	return nil
+}
+
+func pendingUploads() error {
+	var ups []pendingUpload
+	if err := call("GET", *node, "/uploads", &ups); err != nil {
+		return err
+	}
+	show(ups, "BUCKET\tKEY\tSIZE\tAGE\tATTEMPTS\tLAST ERROR", func(w io.Writer) {
+		for _, up := range ups {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", up.Bucket, up.Key, size(up.Size),
+				time.Since(up.Started).Truncate(time.Second), up.Attempts, up.LastError)
+		}
+	})
+	return nil
+}
+
+func validate(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("validate needs a config file")
+	}
+	conf, errs := loadArgs.Validate(args[0])
+	if conf != nil {
+		if _, err := policy.New(conf.Buckets); err != nil {
+			errs = append(errs, fmt.Errorf("Buckets: %v", err))
+		}
+	}
+	problems := []string{}
+	for _, err := range errs {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) == 0 && *output == "table" {
+		fmt.Println(args[0], "is valid")
+		return nil
+	}
+	show(problems, "PROBLEM", func(w io.Writer) {
+		for _, p := range problems {
+			fmt.Fprintln(w, p)
+		}
+	})
+	if len(problems) > 0 {
+		return fmt.Errorf("%s is not valid", args[0])
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() == 0 || (*output != "table" && *output != "json") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	args := flag.Args()[1:]
+	var err error
+	switch flag.Arg(0) {
+	case "cluster":
+		err = clusterStatus()
+	case "stats":
+		err = stats()
+	case "ls":
+		err = list(args)
+	case "purge":
+		err = purge(args)
+	case "warm":
+		err = warm(args)
+	case "drain":
+		err = drain()
+	case "uploads":
+		err = pendingUploads()
+	case "validate":
+		err = validate(args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "s3envoyctl:", err)
+		os.Exit(1)
+	}
+}
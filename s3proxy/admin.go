@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"s3envoy/hashes"
+	"s3envoy/loadArgs"
+	"s3envoy/queues"
+	"strings"
+	"time"
+
+	"github.com/Nitro/memberlist"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+//cacheEntry describes a cached object for the admin API
+type cacheEntry struct {
+	Bucket     string
+	Key        string
+	Size       int64
+	Tier       string //mem or disk
+	Pinned     bool
+	Added      time.Time
+	AgeSeconds int64
+}
+
+//cacheEntryDetail adds what's only shown for a single entry
+type cacheEntryDetail struct {
+	cacheEntry
+	LocalFname string
+	Checksum   string
+	Length     int64  //of the content, Size is what it takes in the cache
+	Encoding   string `json:",omitempty"`
+	Meta       *queues.Metadata
+}
+
+//purgeResult lists the keys a purge dropped from this node
+type purgeResult struct {
+	Bucket  string
+	Purged  []string
+	Cluster bool
+}
+
+func entryOf(node *queues.Node) cacheEntry {
+	tier := "disk"
+	if node.Inmem == true {
+		tier = "mem"
+	}
+	return cacheEntry{Bucket: node.Bucket, Key: node.Fkey, Size: node.Size(), Tier: tier,
+		Pinned: node.Pinned, Added: node.Added, AgeSeconds: int64(time.Since(node.Added).Seconds())}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorln("Could not encode admin response", err)
+	}
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"Error": msg})
+}
+
+//withAdminToken rejects admin requests without the AdminToken, when one is set
+func withAdminToken(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			adminError(w, http.StatusUnauthorized, "A valid admin token is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//purgeLocal drops a key, or every key with the prefix, from the local cache
+func purgeLocal(bucket string, fkey string, prefix bool) []string {
+	if prefix == true {
+		return lru.Purge(bucket, fkey)
+	}
+	if lru.Remove(fkey, bucket) == true {
+		return []string{fkey}
+	}
+	return nil
+}
+
+func adminList(w http.ResponseWriter, r *http.Request) {
+	bucket := r.URL.Query().Get("bucket")
+	prefix := r.URL.Query().Get("prefix")
+	entries := []cacheEntry{}
+	for _, node := range lru.Nodes() {
+		if (bucket == "" || node.Bucket == bucket) && strings.HasPrefix(node.Fkey, prefix) {
+			entries = append(entries, entryOf(node))
+		}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func adminEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	node := lru.Peek(vars["key"], vars["bucket"])
+	if node == nil {
+		adminError(w, http.StatusNotFound, "Not in the local cache")
+		return
+	}
+	writeJSON(w, http.StatusOK, &cacheEntryDetail{cacheEntry: entryOf(node),
+		LocalFname: node.LocalFname, Checksum: node.Checksum, Length: node.Length, Encoding: node.Encoding,
+		Meta: node.Meta})
+}
+
+//adminPurge drops /cache/{bucket}/{key} from the cache.  With prefix=true the key is a prefix
+//and everything under it goes, with cluster=true every live peer is asked to do the same
+func adminPurge(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) {
+	vars := mux.Vars(r)
+	bucket := vars["bucket"]
+	fkey := vars["key"]
+	prefix := r.URL.Query().Get("prefix") == "true"
+	cluster := r.URL.Query().Get("cluster") == "true"
+	if fkey == "" && prefix == false {
+		adminError(w, http.StatusBadRequest, "A key is required unless purging a prefix")
+		return
+	}
+	if cluster == true && args.Cluster == false {
+		adminError(w, http.StatusBadRequest, "Not running as a cluster")
+		return
+	}
+
+	purged := purgeLocal(bucket, fkey, prefix)
+	log.Infoln("Admin purge", bucket, fkey, "prefix:", prefix, "purged:", len(purged))
+	if cluster == true {
+		hashes.Ghash.PurgeGH(fkey, bucket, prefix)
+	}
+	writeJSON(w, http.StatusOK, &purgeResult{Bucket: bucket, Purged: purged, Cluster: cluster})
+}
+
+func adminPin(w http.ResponseWriter, r *http.Request, pinned bool) {
+	vars := mux.Vars(r)
+	var node *queues.Node
+	ok, err := lru.Pin(vars["key"], vars["bucket"], pinned)
+	if err == queues.ErrPinnedFull {
+		adminError(w, http.StatusInsufficientStorage, err.Error())
+		return
+	} else if err != nil {
+		adminError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if ok == true {
+		node = lru.Peek(vars["key"], vars["bucket"])
+	}
+	if node == nil {
+		adminError(w, http.StatusNotFound, "Not in the local cache")
+		return
+	}
+	writeJSON(w, http.StatusOK, entryOf(node))
+}
+
+//nodeStats is this node's view of its cache, as shown by s3envoyctl
+type nodeStats struct {
+	Name    string
+	Cluster bool
+	queues.Stats
+	PendingUploads int
+	GlobalHashSize int
+}
+
+//member of the cluster as seen by memberlist
+type member struct {
+	Name  string
+	Addr  string
+	Alive bool
+}
+
+func adminStats(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) {
+	stats := nodeStats{Name: args.LocalName, Cluster: args.Cluster, Stats: lru.Stats()}
+	stats.PendingUploads = len(uploads.list())
+	if args.Cluster == true {
+		stats.GlobalHashSize = len(hashes.Ghash.Dump())
+	}
+	writeJSON(w, http.StatusOK, &stats)
+}
+
+func adminMembers(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) {
+	members := []member{}
+	if args.Members != nil {
+		for _, node := range args.Members.Members() {
+			members = append(members, member{Name: node.Name, Addr: node.Addr.String(),
+				Alive: node.State == memberlist.StateAlive})
+		}
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+func adminUploads(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, uploads.list())
+}
+
+//adminWarm fetches an object from the backend into the local cache if it isn't there already
+func adminWarm(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) {
+	vars := mux.Vars(r)
+	bucket := vars["bucket"]
+	fkey := vars["key"]
+	if errB := checkBucketName(bucket); errB != nil {
+		adminError(w, errB.Code, errB.Message)
+		return
+	}
+	node := lru.Peek(fkey, bucket)
+	if node == nil {
+		idx := strings.LastIndex(fkey, "/") + 1
+		file, _, errC := cacheFromS3(bucket, fkey[:idx], fkey[idx:], args)
+		if errC != nil {
+			adminError(w, errC.Code, errC.Message)
+			return
+		}
+		file.Close()
+	}
+	if node = lru.Peek(fkey, bucket); node == nil {
+		adminError(w, http.StatusInsufficientStorage, "Fetched but could not be cached")
+		return
+	}
+	writeJSON(w, http.StatusOK, entryOf(node))
+}
+
+//adminDrain withdraws this node's objects from the global hash ahead of taking it out of
+//the cluster.  It keeps serving requests and finishing uploads
+func adminDrain(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) {
+	lru.Drain()
+	if args.Cluster == true {
+		go hashes.Ghash.Leave()
+	}
+	log.Infoln("Draining, objects are no longer advertised to peers")
+	adminStats(w, r, args)
+}
+
+func adminGlobalHash(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) {
+	if args.Cluster == false {
+		adminError(w, http.StatusNotFound, "Not running as a cluster")
+		return
+	}
+	writeJSON(w, http.StatusOK, hashes.Ghash.Dump())
+}
+
+//adminServer serves the admin API on its own port, it should not be reachable by S3 clients.
+//It returns the server for shutdown to stop, nil without an AdminPort
+func adminServer(args *loadArgs.Args) *http.Server {
+	if args.AdminPort == "" {
+		return nil
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/cache", adminList).Methods("GET")
+	router.HandleFunc("/cache/{bucket}/{key:.+}", adminEntry).Methods("GET")
+	router.HandleFunc("/cache/{bucket}/{key:.*}", func(w http.ResponseWriter, r *http.Request) {
+		adminPurge(w, r, args)
+	}).Methods("DELETE")
+	router.HandleFunc("/pin/{bucket}/{key:.+}", func(w http.ResponseWriter, r *http.Request) {
+		adminPin(w, r, true)
+	}).Methods("PUT", "POST")
+	router.HandleFunc("/pin/{bucket}/{key:.+}", func(w http.ResponseWriter, r *http.Request) {
+		adminPin(w, r, false)
+	}).Methods("DELETE")
+	router.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		adminStats(w, r, args)
+	}).Methods("GET")
+	router.HandleFunc("/members", func(w http.ResponseWriter, r *http.Request) {
+		adminMembers(w, r, args)
+	}).Methods("GET")
+	router.HandleFunc("/uploads", adminUploads).Methods("GET")
+	router.HandleFunc("/warm/{bucket}/{key:.+}", func(w http.ResponseWriter, r *http.Request) {
+		adminWarm(w, r, args)
+	}).Methods("POST")
+	router.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		adminDrain(w, r, args)
+	}).Methods("POST")
+	router.HandleFunc("/globalhash", func(w http.ResponseWriter, r *http.Request) {
+		adminGlobalHash(w, r, args)
+	}).Methods("GET")
+
+	//admin requests have no body to wait for
+	server := &http.Server{Addr: net.JoinHostPort(args.AdminAddress, args.AdminPort),
+		Handler: withAdminToken(router, args.AdminToken), ReadHeaderTimeout: headerTimeout,
+		ReadTimeout: headerTimeout, IdleTimeout: idleTimeout}
+	log.Infoln("Admin API listening on", server.Addr)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorln("Admin API stopped:", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"s3envoy/backend"
+	"s3envoy/queues"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//S3 error codes returned to clients.  Upstream codes are passed through as-is
+const (
+	errCodeInternal     = "InternalError"
+	errCodeAccessDenied = "AccessDenied"
+	errCodeSlowDown     = "SlowDown"
+)
+
+//AppError is the struct for error handling
+type AppError struct {
+	Error     error
+	Message   string
+	Code      int    //HTTP status code returned to the client
+	S3Code    string //S3 error code, e.g. NoSuchKey
+	RequestID string //upstream request id, if the error came from S3
+}
+
+//s3ErrorResponse is the standard S3 XML error body
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId"`
+}
+
+//internalError wraps a local failure (disk, memory) as an S3 InternalError
+func internalError(err error, message string) *AppError {
+	return &AppError{Error: err, Message: message, Code: http.StatusInternalServerError, S3Code: errCodeInternal}
+}
+
+//noSpaceError tells the client to back off while the cache disks are critically full
+func noSpaceError(err error) *AppError {
+	return &AppError{Error: err, Message: "Please reduce your request rate.", Code: http.StatusServiceUnavailable,
+		S3Code: errCodeSlowDown}
+}
+
+//checkBucketName rejects the bucket names S3 doesn't allow that would reach the cache's own
+//directories, such as .meta and .blobs
+func checkBucketName(bucketName string) *AppError {
+	if strings.HasPrefix(bucketName, ".") {
+		return &AppError{Message: "The specified bucket is not valid.", Code: http.StatusBadRequest, S3Code: "InvalidBucketName"}
+	}
+	return nil
+}
+
+//diskFull is true for errors meaning the cache disks have no room left
+func diskFull(err error) bool {
+	if err == queues.ErrNoSpace {
+		return true
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.ENOSPC
+}
+
+//upstreamError translates an error returned by the backend into an AppError, keeping
+//the upstream S3 code, message and status where available
+func upstreamError(err error, message string) *AppError {
+	berr, ok := err.(*backend.Error)
+	if !ok {
+		return internalError(err, message)
+	}
+	appErr := &AppError{Error: berr.Err, Message: berr.Message, Code: berr.Status,
+		S3Code: berr.Code, RequestID: berr.RequestID}
+	if appErr.Error == nil {
+		appErr.Error = err
+	}
+	return appErr
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "0000000000000000"
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+//writeError sends the AppError to the client as an S3 style XML error document
+func writeError(w http.ResponseWriter, r *http.Request, appErr *AppError) {
+	if appErr.Code == 0 {
+		appErr.Code = http.StatusInternalServerError
+	}
+	if appErr.S3Code == "" {
+		appErr.S3Code = errCodeInternal
+	}
+	reqID := appErr.RequestID
+	if reqID == "" {
+		reqID = newRequestID()
+	}
+	if appErr.Error != nil {
+		log.Errorln(appErr.S3Code, appErr.Message, appErr.Error)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-amz-request-id", reqID)
+	w.WriteHeader(appErr.Code)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	body := &s3ErrorResponse{Code: appErr.S3Code, Message: appErr.Message,
+		Resource: r.URL.Path, RequestID: reqID}
+	data, err := xml.Marshal(body)
+	if err != nil {
+		log.Errorln("Could not marshal error response", err)
+		return
+	}
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"s3envoy/backend"
+	"s3envoy/loadArgs"
+	"s3envoy/queues"
+	"sync"
+	"time"
+)
+
+//version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+var started = time.Now()
+
+//circuitThreshold is how many backend calls in a row have to fail before s3envoy stops
+//reporting ready
+const circuitThreshold = 5
+
+//circuit tracks whether the backend is reachable from the outcome of real requests, rather
+//than probing it
+type circuit struct {
+	mutex       sync.Mutex
+	failures    int //consecutive failed calls
+	lastError   string
+	lastSuccess time.Time
+}
+
+var upstream = &circuit{}
+
+//record the outcome of a backend call.  Errors S3 answered with, like NoSuchKey, still show
+//it's reachable
+func (c *circuit) record(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if be, ok := err.(*backend.Error); err == nil || ok && be.Status > 0 && be.Status < 500 {
+		c.failures = 0
+		c.lastSuccess = time.Now()
+		return
+	}
+	c.failures++
+	c.lastError = err.Error()
+}
+
+//upstreamState is the circuit as shown by /status
+type upstreamState struct {
+	Closed      bool
+	Failures    int
+	LastError   string `json:",omitempty"`
+	LastSuccess time.Time
+}
+
+func (c *circuit) state() upstreamState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return upstreamState{Closed: c.failures < circuitThreshold, Failures: c.failures,
+		LastError: c.lastError, LastSuccess: c.lastSuccess}
+}
+
+//peerState of a configured peer
+type peerState struct {
+	Peer  string
+	Alive bool
+}
+
+type status struct {
+	Version        string
+	Started        time.Time
+	UptimeSeconds  int64
+	Ready          bool
+	Problems       []string `json:",omitempty"`
+	Cache          queues.Stats
+	PendingUploads int
+	Upstream       upstreamState
+	Cluster        bool
+	Peers          []peerState `json:",omitempty"`
+}
+
+//readiness lists what stops this node from taking traffic, nothing if it's ready
+func readiness(args *loadArgs.Args) []string {
+	var problems []string
+	//LocalPath, or the CacheDirs still in use, one writable directory is enough to take objects
+	healthy := 0
+	var unwritable []string
+	for _, dir := range lru.Stats().Dirs {
+		if dir.Healthy == false {
+			continue
+		}
+		healthy++
+		probe, err := ioutil.TempFile(dir.Path, ".readyz")
+		if err != nil {
+			unwritable = append(unwritable, "cache dir not writable: "+err.Error())
+			continue
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+	if healthy == 0 {
+		problems = append(problems, "every cache dir has failed")
+	} else if len(unwritable) == healthy {
+		problems = append(problems, unwritable...)
+	}
+	if st := upstream.state(); st.Closed == false {
+		problems = append(problems, "backend unreachable: "+st.LastError)
+	}
+	if args.Cluster == true && (args.Members == nil || args.Members.NumMembers() < 2) {
+		problems = append(problems, "not joined to the cluster")
+	}
+	if lru.Draining() == true {
+		problems = append(problems, "draining")
+	}
+	return problems
+}
+
+//dirChecker probes the cache directories for disk failures, see queues.Queue.CheckDirs
+func dirChecker(args *loadArgs.Args) {
+	if args.DirCheckInterval <= 0 {
+		return
+	}
+	for range time.Tick(args.DirCheckInterval) {
+		lru.CheckDirs()
+	}
+}
+
+//spaceChecker keeps the cache disks between their watermarks, see queues.Queue.CheckSpace
+func spaceChecker(args *loadArgs.Args) {
+	if args.WatermarkInterval <= 0 {
+		return
+	}
+	lru.CheckSpace()
+	for range time.Tick(args.WatermarkInterval) {
+		lru.CheckSpace()
+	}
+}
+
+//expirer drops objects past their retention rule's MaxAge, see queues.Queue.Expire
+func expirer() {
+	interval := lru.ExpireInterval()
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		lru.Expire()
+	}
+}
+
+//healthz only shows the process is up and serving
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+func readyz(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) {
+	problems := readiness(args)
+	w.Header().Set("Content-Type", "text/plain")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, p := range problems {
+			w.Write([]byte(p + "\n"))
+		}
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) {
+	st := &status{Version: version, Started: started, UptimeSeconds: int64(time.Since(started).Seconds()),
+		Upstream: upstream.state(), Cluster: args.Cluster, PendingUploads: len(uploads.list())}
+	st.Problems = readiness(args)
+	st.Ready = len(st.Problems) == 0
+	st.Cache = lru.Stats()
+	if args.Cluster == true && args.Members != nil {
+		for _, peer := range args.PeerList() {
+			st.Peers = append(st.Peers, peerState{Peer: peer, Alive: args.CheckMemberAlive(peer)})
+		}
+	}
+	writeJSON(w, http.StatusOK, st)
+}
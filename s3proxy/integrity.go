@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"net/http"
+	"s3envoy/backend"
+	"s3envoy/loadArgs"
+	"s3envoy/queues"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	errCodeBadDigest     = "BadDigest"
+	errCodeInvalidDigest = "InvalidDigest"
+)
+
+//checksumPrefix is the header prefix for the additional checksums S3 accepts on a PUT
+const checksumPrefix = "x-amz-checksum-"
+
+//checksumAlgos are the x-amz-checksum-* algorithms S3 supports
+var checksumAlgos = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+//digester hashes object content as it streams to or from the local cache
+type digester struct {
+	md5      hash.Hash
+	sha256   hash.Hash
+	algo     string    //x-amz-checksum algorithm the client asked for, if any
+	checksum hash.Hash //hash for algo
+}
+
+//newDigester sets up the hashes for an object.  The request headers are checked for an
+//x-amz-checksum-* header so the matching algorithm is computed in the same pass
+func newDigester(h http.Header) *digester {
+	d := &digester{md5: md5.New(), sha256: sha256.New()}
+	if h == nil {
+		return d
+	}
+	for algo, newHash := range checksumAlgos {
+		if h.Get(checksumPrefix+algo) != "" {
+			d.algo = algo
+			d.checksum = newHash()
+			break
+		}
+	}
+	return d
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	d.md5.Write(p)
+	d.sha256.Write(p)
+	if d.checksum != nil {
+		d.checksum.Write(p)
+	}
+	return len(p), nil
+}
+
+//ETag is the quoted hex MD5, as S3 returns for a single part upload
+func (d *digester) ETag() string {
+	return "\"" + hex.EncodeToString(d.md5.Sum(nil)) + "\""
+}
+
+//Checksum is the hex SHA-256 stored with the cache node
+func (d *digester) Checksum() string {
+	return hex.EncodeToString(d.sha256.Sum(nil))
+}
+
+//verify checks the computed digests against the Content-MD5 and x-amz-checksum-* headers
+func (d *digester) verify(h http.Header) *AppError {
+	if contentMD5 := h.Get("Content-MD5"); contentMD5 != "" {
+		expected, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(expected) != md5.Size {
+			return &AppError{Error: err, Message: "The Content-MD5 you specified was invalid.",
+				Code: http.StatusBadRequest, S3Code: errCodeInvalidDigest}
+		}
+		if base64.StdEncoding.EncodeToString(d.md5.Sum(nil)) != contentMD5 {
+			return &AppError{Message: "The Content-MD5 you specified did not match what we received.",
+				Code: http.StatusBadRequest, S3Code: errCodeBadDigest}
+		}
+	}
+	//the SigV4 payload hash, when the client signed the body
+	if payloadHash := h.Get("X-Amz-Content-Sha256"); len(payloadHash) == 2*sha256.Size && payloadHash != d.Checksum() {
+		return &AppError{Message: "The provided 'x-amz-content-sha256' header does not match what was computed.",
+			Code: http.StatusBadRequest, S3Code: "XAmzContentSHA256Mismatch"}
+	}
+	if d.checksum != nil {
+		expected := h.Get(checksumPrefix + d.algo)
+		if base64.StdEncoding.EncodeToString(d.checksum.Sum(nil)) != expected {
+			return &AppError{Message: "The " + checksumPrefix + d.algo + " you specified did not match the calculated checksum.",
+				Code: http.StatusBadRequest, S3Code: errCodeBadDigest}
+		}
+	}
+	return nil
+}
+
+//matchesETag compares the content MD5 with the ETag of an object from the backend.  Multipart,
+//SSE-KMS and SSE-C ETags are not an MD5 of the content, so those can't be checked and count as a match
+func (d *digester) matchesETag(obj *backend.Object) bool {
+	if obj.Meta == nil || obj.ETagIsMD5() == false {
+		return true
+	}
+	etag := strings.Trim(obj.Meta.ETag, "\"")
+	if len(etag) != 2*md5.Size || strings.Contains(etag, "-") {
+		return true
+	}
+	return strings.EqualFold(etag, strings.Trim(d.ETag(), "\""))
+}
+
+//contentMD5 converts a quoted hex MD5 ETag into the base64 form of the Content-MD5 header
+func contentMD5(etag string) string {
+	sum, err := hex.DecodeString(strings.Trim(etag, "\""))
+	if err != nil || len(sum) != md5.Size {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+//scrubber periodically rehashes cached objects and evicts any whose content no longer
+//matches the checksum taken when they were cached
+func scrubber(args *loadArgs.Args) {
+	if args.ScrubInterval <= 0 {
+		return
+	}
+	for range time.Tick(args.ScrubInterval) {
+		for _, node := range lru.Nodes() {
+			scrub(node, args)
+		}
+	}
+}
+
+//scrub verifies one object.  A corrupt one is evicted and refetched from S3, unless it has an
+//upload pending and S3 doesn't have that content yet.  One that couldn't be read is kept and
+//tried again next time, a failing disk is CheckDirs' to deal with
+func scrub(node *queues.Node, args *loadArgs.Args) {
+	ok, err := lru.Verify(node)
+	if ok {
+		return
+	}
+	if err != nil {
+		log.Warnln("Could not verify cached object, will retry", node.Bucket, node.Fkey, err)
+		return
+	}
+	//skip objects overwritten or dropped since the snapshot
+	if current := lru.Peek(node.Fkey, node.Bucket); current == nil || current.Checksum != node.Checksum {
+		return
+	}
+	//until it's uploaded the cache file is the only copy, and S3 still has the old one
+	if uploads.pendingFor(node.Bucket, node.Fkey) == true {
+		log.Errorln("Cached object failed verification but has an upload pending, keeping it", node.Bucket, node.Fkey)
+		return
+	}
+	log.Errorln("Cached object failed verification, evicting", node.Bucket, node.Fkey)
+	lru.Remove(node.Fkey, node.Bucket)
+
+	idx := strings.LastIndex(node.Fkey, "/") + 1
+	file, _, errC := cacheFromS3(node.Bucket, node.Fkey[:idx], node.Fkey[idx:], args)
+	if errC != nil {
+		log.Errorln("Could not refetch corrupt object", node.Bucket, node.Fkey, errC.Message)
+		return
+	}
+	file.Close()
+}
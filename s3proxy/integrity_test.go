@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"s3envoy/backend"
+	"s3envoy/queues"
+	"testing"
+)
+
+func TestMatchesETag(t *testing.T) {
+	content := []byte("Welcome to Amazon S3.")
+	sum := md5.Sum(content)
+	md5ETag := "\"" + hex.EncodeToString(sum[:]) + "\""
+	otherETag := "\"" + hex.EncodeToString(make([]byte, md5.Size)) + "\""
+
+	cases := []struct {
+		name        string
+		etag        string
+		encryption  string
+		customerKey bool
+		want        bool
+	}{
+		{name: "md5", etag: md5ETag, want: true},
+		{name: "unquoted md5", etag: hex.EncodeToString(sum[:]), want: true},
+		{name: "corrupt", etag: otherETag, want: false},
+		{name: "sse-s3 corrupt", etag: otherETag, encryption: "AES256", want: false},
+		{name: "sse-s3", etag: md5ETag, encryption: "AES256", want: true},
+		{name: "multipart", etag: "\"" + hex.EncodeToString(make([]byte, md5.Size)) + "-3\"", want: true},
+		{name: "sse-kms", etag: otherETag, encryption: "aws:kms", want: true},
+		{name: "dual layer sse-kms", etag: otherETag, encryption: "aws:kms:dsse", want: true},
+		{name: "sse-c", etag: otherETag, customerKey: true, want: true},
+		{name: "no etag", etag: "", want: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			digests := newDigester(nil)
+			digests.Write(content)
+			obj := &backend.Object{Meta: &queues.Metadata{ETag: c.etag}, Encryption: c.encryption, CustomerKey: c.customerKey}
+			if got := digests.matchesETag(obj); got != c.want {
+				t.Fatalf("matchesETag(%s) is %v, expected %v", c.etag, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//maxListKeys is the S3 default and upper limit for max-keys
+const maxListKeys = 1000
+
+type listContents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+//listBucketResult is the S3 ListObjects (v1) response body
+type listBucketResult struct {
+	XMLName     xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string         `xml:"Name"`
+	Prefix      string         `xml:"Prefix"`
+	Marker      string         `xml:"Marker"`
+	MaxKeys     int            `xml:"MaxKeys"`
+	IsTruncated bool           `xml:"IsTruncated"`
+	Contents    []listContents `xml:"Contents"`
+}
+
+//s3List lists a bucket through the backend.  Listings are not cached
+func s3List(w http.ResponseWriter, r *http.Request, bucketName string) *AppError {
+	query := r.URL.Query()
+	maxKeys := maxListKeys
+	if mk := query.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			return &AppError{Error: err, Message: "Provided max-keys not an integer or within integer range",
+				Code: http.StatusBadRequest, S3Code: "InvalidArgument"}
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	listing, err := store.List(bucketName, query.Get("prefix"), query.Get("marker"), maxKeys)
+	if err != nil {
+		return upstreamError(err, "Could not List S3 bucket")
+	}
+	result := &listBucketResult{Name: bucketName, Prefix: query.Get("prefix"), Marker: query.Get("marker"),
+		MaxKeys: maxKeys, IsTruncated: listing.IsTruncated}
+	for _, obj := range listing.Objects {
+		result.Contents = append(result.Contents, listContents{Key: obj.Key,
+			LastModified: obj.LastModified.UTC().Format(time.RFC3339), ETag: obj.ETag,
+			Size: obj.Size, StorageClass: "STANDARD"})
+	}
+	data, errM := xml.Marshal(result)
+	if errM != nil {
+		return internalError(errM, "Could not marshal bucket listing")
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write([]byte(xml.Header))
+		w.Write(data)
+	}
+	return nil
+}
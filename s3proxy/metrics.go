@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"s3envoy/backend"
+	"s3envoy/metrics"
+	"s3envoy/queues"
+	"strconv"
+	"time"
+)
+
+//statusWriter records the status, size and source of a response for the request metrics
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	source string
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+//setSource tags the request with where its object was served from
+func setSource(w http.ResponseWriter, source string) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.source = source
+	}
+}
+
+//instrumented wraps a handler to count requests, bytes and latency
+func instrumented(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, source: metrics.SourceNone}
+		handler(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		metrics.Requests.WithLabelValues(r.Method, strconv.Itoa(sw.status), sw.source).Inc()
+		metrics.BytesServed.WithLabelValues(sw.source).Add(float64(sw.bytes))
+		metrics.RequestDuration.WithLabelValues(r.Method, sw.source).Observe(time.Since(start).Seconds())
+	}
+}
+
+//timedBackend records the latency and outcome of every backend call
+type timedBackend struct {
+	backend.Backend
+}
+
+func observe(operation string, start time.Time) {
+	metrics.UpstreamDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+//track records the call's latency and its outcome for the readiness circuit
+func track(operation string, start time.Time, err error) {
+	observe(operation, start)
+	upstream.record(err)
+}
+
+func (b timedBackend) Get(bucket string, key string) (obj *backend.Object, err error) {
+	defer func(start time.Time) { track("get", start, err) }(time.Now())
+	return b.Backend.Get(bucket, key)
+}
+
+func (b timedBackend) GetRange(bucket string, key string, offset int64, length int64) (obj *backend.Object, err error) {
+	defer func(start time.Time) { track("get_range", start, err) }(time.Now())
+	return b.Backend.GetRange(bucket, key, offset, length)
+}
+
+func (b timedBackend) Head(bucket string, key string) (obj *backend.Object, err error) {
+	defer func(start time.Time) { track("head", start, err) }(time.Now())
+	return b.Backend.Head(bucket, key)
+}
+
+func (b timedBackend) Put(bucket string, key string, body io.ReadSeeker, size int64, meta *queues.Metadata) (obj *backend.Object, err error) {
+	defer func(start time.Time) { track("put", start, err) }(time.Now())
+	return b.Backend.Put(bucket, key, body, size, meta)
+}
+
+func (b timedBackend) Delete(bucket string, key string) (err error) {
+	defer func(start time.Time) { track("delete", start, err) }(time.Now())
+	return b.Backend.Delete(bucket, key)
+}
+
+func (b timedBackend) List(bucket string, prefix string, marker string, max int) (listing *backend.Listing, err error) {
+	defer func(start time.Time) { track("list", start, err) }(time.Now())
+	return b.Backend.List(bucket, prefix, marker, max)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"s3envoy/backend"
+	"s3envoy/loadArgs"
+	"s3envoy/queues"
+	"strings"
+	"testing"
+	"time"
+)
+
+//newTestProxy points the proxy's globals at a fresh cache and the named offline backend, and
+//serves the client routes.  The caller closes the server and removes dir
+func newTestProxy(t *testing.T, backendName string) (*httptest.Server, string, *loadArgs.Args) {
+	dir, err := ioutil.TempDir("", "s3envoy-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, _ := json.Marshal(map[string]interface{}{"LocalPath": dir + "/cache/", "Cluster": "False",
+		"Backend": backendName, "BackendPath": dir + "/backend"})
+	if err = ioutil.WriteFile(dir+"/config.json", conf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	args, errs := loadArgs.Validate(dir + "/config.json")
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	lru = queues.InitializeQueue(args)
+	if store, err = backend.New(args); err != nil {
+		t.Fatal(err)
+	}
+	verifier, bucketPolicy = nil, nil
+	//the fs backend only serves buckets that exist
+	os.MkdirAll(dir+"/backend/bkt", 0755)
+	return httptest.NewServer(clientRouter(args)), dir, args
+}
+
+func request(t *testing.T, method string, url string, body []byte, header map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp, data
+}
+
+func TestProxyOffline(t *testing.T) {
+	content := []byte("hello from an offline backend, with enough bytes to take a range of")
+	for _, name := range []string{"memory", "fs"} {
+		server, dir, _ := newTestProxy(t, name)
+		url := server.URL + "/bkt/dir/key"
+		expect := func(what string, resp *http.Response, status int) {
+			if resp.StatusCode != status {
+				t.Errorf("%s %s: status %d, expected %d", name, what, resp.StatusCode, status)
+			}
+		}
+
+		resp, _ := request(t, "PUT", url, content, map[string]string{"Content-Type": "text/plain"})
+		expect("put", resp, http.StatusOK)
+		if uploads.wait(time.Now().Add(5*time.Second)) == false {
+			t.Fatalf("%s: the upload didn't finish", name)
+		}
+		if obj, err := store.Head("bkt", "dir/key"); err != nil || obj.Size != int64(len(content)) {
+			t.Fatalf("%s: uploaded %v, error %v", name, obj, err)
+		}
+
+		//cached by the PUT, then fetched from the backend once it's dropped from the cache
+		for _, cached := range []bool{true, false} {
+			if cached == false {
+				lru.Remove("dir/key", "bkt")
+			}
+			resp, data := request(t, "GET", url, nil, nil)
+			expect("get", resp, http.StatusOK)
+			if bytes.Equal(data, content) == false || resp.Header.Get("Content-Type") != "text/plain" {
+				t.Errorf("%s: got %q as %s, cached %v", name, data, resp.Header.Get("Content-Type"), cached)
+			}
+			resp, _ = request(t, "HEAD", url, nil, nil)
+			expect("head", resp, http.StatusOK)
+			if resp.ContentLength != int64(len(content)) {
+				t.Errorf("%s: head has length %d, cached %v", name, resp.ContentLength, cached)
+			}
+		}
+		for _, cached := range []bool{true, false} {
+			if cached == false {
+				lru.Remove("dir/key", "bkt")
+			}
+			resp, data := request(t, "GET", url, nil, map[string]string{"Range": "bytes=6-9"})
+			expect("range", resp, http.StatusPartialContent)
+			if string(data) != "from" {
+				t.Errorf("%s: range got %q, cached %v", name, data, cached)
+			}
+			resp, _ = request(t, "GET", url, nil, map[string]string{"Range": "bytes=1000-"})
+			expect("unsatisfiable range", resp, http.StatusRequestedRangeNotSatisfiable)
+		}
+
+		resp, data := request(t, "GET", server.URL+"/bkt/", nil, nil)
+		expect("list", resp, http.StatusOK)
+		if strings.Contains(string(data), "<Key>dir/key</Key>") == false {
+			t.Errorf("%s: listing %s", name, data)
+		}
+
+		resp, data = request(t, "GET", server.URL+"/bkt/dir/absent", nil, nil)
+		expect("get missing", resp, http.StatusNotFound)
+		if strings.Contains(string(data), "NoSuchKey") == false {
+			t.Errorf("%s: missing object got %s", name, data)
+		}
+
+		resp, _ = request(t, "DELETE", url, nil, nil)
+		expect("delete", resp, http.StatusNoContent)
+		resp, _ = request(t, "GET", url, nil, nil)
+		expect("get deleted", resp, http.StatusNotFound)
+
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	server, dir, args := newTestProxy(t, "memory")
+	defer os.RemoveAll(dir)
+	defer server.Close()
+	content := []byte("content the scrubber checks against its checksum")
+	for _, key := range []string{"damaged", "unreadable"} {
+		resp, _ := request(t, "PUT", server.URL+"/bkt/"+key, content, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("put %s: status %d", key, resp.StatusCode)
+		}
+	}
+	if uploads.wait(time.Now().Add(5*time.Second)) == false {
+		t.Fatal("the uploads didn't finish")
+	}
+
+	//one that can't be read is left for the next pass
+	unreadable := lru.Peek("unreadable", "bkt")
+	os.Remove(unreadable.LocalFname)
+	os.Mkdir(unreadable.LocalFname, 0755)
+	scrub(unreadable, args)
+	if node := lru.Peek("unreadable", "bkt"); node == nil || node.Added != unreadable.Added {
+		t.Fatal("an object that couldn't be read was evicted")
+	}
+
+	//a damaged copy is replaced with the backend's
+	damaged := lru.Peek("damaged", "bkt")
+	ioutil.WriteFile(damaged.LocalFname, []byte("content the scrubber checks against its checksuM"), 0644)
+	scrub(damaged, args)
+	node := lru.Peek("damaged", "bkt")
+	if node == nil {
+		t.Fatal("the damaged copy wasn't refetched")
+	}
+	if ok, err := lru.Verify(node); ok == false {
+		t.Fatalf("the refetched copy failed verification, error %v", err)
+	}
+	if _, data := request(t, "GET", server.URL+"/bkt/damaged", nil, nil); bytes.Equal(data, content) == false {
+		t.Fatalf("got %q after scrubbing", data)
+	}
+}
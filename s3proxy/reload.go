@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"s3envoy/loadArgs"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//reloadMutex keeps a SIGHUP and watchConfig from reloading at the same time
+var reloadMutex sync.Mutex
+
+//reload applies a changed config file to the running node, on SIGHUP or when watchConfig
+//sees the file change.  A rejected reload leaves everything as it was
+func reload(conf string, args *loadArgs.Args) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	masters := args.MasterKeys()
+	added, err := args.Reload(conf, lru.Resize)
+	if err != nil {
+		log.Errorln("Config reload rejected:", err)
+		return
+	}
+
+	//after a key rotation what's cached moves to the new master key, so the old one can go
+	if rotated := args.MasterKeys(); len(masters) > 0 && bytes.Equal(masters[0], rotated[0]) == false {
+		go func() {
+			rewrapped, errR := lru.Rewrap()
+			if errR != nil {
+				log.Errorln("Could not rewrap every cache file with the current master key:", errR)
+			}
+			log.Infoln("Rewrapped the data keys of", rewrapped, "cache files with the current master key")
+		}()
+	}
+
+	if len(added) > 0 && args.Members != nil {
+		var memberIPs []string
+		for _, peer := range added {
+			memberIPs = append(memberIPs, strings.Split(peer, ":")[0])
+		}
+		if _, errJ := args.Members.Join(memberIPs); errJ != nil {
+			log.Errorln("Failed to join new peers:", errJ)
+		}
+	}
+	log.Infoln("Config reloaded from", conf)
+}
+
+//watchConfig reloads the config file whenever its modification time changes
+func watchConfig(conf string, args *loadArgs.Args) {
+	if args.ConfigWatch <= 0 {
+		return
+	}
+	var last time.Time
+	if info, err := os.Stat(conf); err == nil {
+		last = info.ModTime()
+	}
+	for range time.Tick(args.ConfigWatch) {
+		info, err := os.Stat(conf)
+		if err != nil {
+			log.Errorln("Could not check config file:", err)
+			continue
+		}
+		if info.ModTime().Equal(last) {
+			continue
+		}
+		last = info.ModTime()
+		reload(conf, args)
+	}
+}
@@ -1,39 +1,37 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"s3envoy/auth"
+	"s3envoy/backend"
 	"s3envoy/hashes"
 	"s3envoy/loadArgs"
+	"s3envoy/metrics"
+	"s3envoy/policy"
 	"s3envoy/queues"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/Nitro/memberlist"
 	"github.com/gorilla/mux"
 )
 
 var lru *queues.Queue
-var mutex = &sync.RWMutex{} //mutex to control access to shared lru struct
-
-//AppError is the struct for error handling
-type AppError struct {
-	Error   error
-	Message string
-	Code    int
-}
+var verifier *auth.Verifier     //nil when no client access keys are configured
+var bucketPolicy *policy.Policy //nil when any bucket may be used
+var store backend.Backend       //upstream object store
 
 func CheckFileInPeerNode(fkey string, bucketName string, args *loadArgs.Args) (bool, string) {
 	res := "None"
@@ -47,65 +45,207 @@ func CheckFileInPeerNode(fkey string, bucketName string, args *loadArgs.Args) (b
 	return false, ""
 }
 
-func s3Download(bucketName string, dirPath string, fname string, args *loadArgs.Args) (file *os.File, numBytes int64, Apperr *AppError) {
+//authenticate verifies the SigV4 signature of a client request.  It returns the access
+//key id the request was signed with, or "" when no access keys are configured
+func authenticate(r *http.Request) (string, *AppError) {
+	if verifier == nil {
+		return "", nil
+	}
+	identity, err := verifier.Verify(r)
+	if err != nil {
+		if authErr, ok := err.(*auth.Error); ok {
+			return "", &AppError{Error: err, Message: authErr.Message, Code: authErr.Status, S3Code: authErr.Code}
+		}
+		return "", &AppError{Error: err, Message: "Access Denied", Code: http.StatusForbidden, S3Code: errCodeAccessDenied}
+	}
+	return identity, nil
+}
+
+//authorize checks the bucket policy before anything touches the cache or S3
+func authorize(r *http.Request, identity string, bucketName string, fkey string, write bool) *AppError {
+	if bucketPolicy == nil || bucketPolicy.Allowed(identity, r.RemoteAddr, bucketName, fkey, write) {
+		return nil
+	}
+	log.Infoln("Request denied by bucket policy", r.Method, bucketName, fkey, identity, r.RemoteAddr)
+	return &AppError{Message: "Access Denied", Code: http.StatusForbidden, S3Code: errCodeAccessDenied}
+}
+
+//s3Download fetches an object into a cache file, compressed and encrypted if the settings say so.
+//It is written under a temp name and only renamed to localFname once complete, so readers
+//never see a partial file.  numBytes is the size of the content, stored what it takes on disk
+func s3Download(bucketName string, dirPath string, fname string, args *loadArgs.Args) (file *os.File, localFname string, numBytes int64, stored int64, encoding string, meta *queues.Metadata, checksum string, Apperr *AppError) {
 
-	localPath := args.LocalPath + bucketName + "/" + dirPath
-	err := os.MkdirAll(localPath, 0755)
+	obj, err := store.Get(bucketName, dirPath+fname)
 	if err != nil {
-		log.Errorln(err, "Could not create local Directories")
-		return nil, 0, &AppError{err, "Could not create local Directories", 500}
+		log.Errorln(err)
+		return nil, "", 0, 0, "", nil, "", upstreamError(err, "Could not Dowload from S3")
+	}
+	defer obj.Body.Close()
+
+	localFname, err = lru.Place(bucketName, dirPath+fname, obj.Size)
+	if diskFull(err) == true {
+		return nil, "", 0, 0, "", nil, "", noSpaceError(err)
+	} else if err != nil {
+		return nil, "", 0, 0, "", nil, "", internalError(err, "Could not place local File")
 	}
-	file, err = os.Create(localPath + fname)
+	cw, err := lru.NewWriter(localFname, lru.Encoding(obj.Meta))
 	if err != nil {
 		log.Errorln(err, "Could not create local File")
-		return nil, 0, &AppError{err, "Could not create local File", 500}
-	}
-	downloader := s3manager.NewDownloader(session.New(&aws.Config{Region: aws.String("us-west-1")}))
-	numBytes, err = downloader.Download(file,
-		&s3.GetObjectInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(dirPath + fname),
-		})
+		return nil, "", 0, 0, "", nil, "", internalError(err, "Could not create local File")
+	}
+	digests := newDigester(nil)
+	numBytes, err = io.Copy(io.MultiWriter(cw, digests), obj.Body)
+	if err == nil && !digests.matchesETag(obj) {
+		err = fmt.Errorf("downloaded content does not match ETag %s", obj.Meta.ETag)
+	}
+	if err != nil {
+		cw.Abort()
+	} else if file, encoding, stored, err = cw.Finish(); err == nil {
+		//a download can always be fetched again, so it's only synced if everything is
+		localFname, err = lru.Store(file, bucketName, dirPath+fname, localFname, digests.Checksum(), encoding, args.Fsync == "always")
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}
 	if err != nil {
 		log.Errorln(err)
-		return nil, 0, &AppError{err, "Could not Dowload from S3", 500}
+		if diskFull(err) == true {
+			return nil, "", 0, 0, "", nil, "", noSpaceError(err)
+		}
+		return nil, "", 0, 0, "", nil, "", internalError(err, "Could not Dowload from S3")
 	}
-	return file, numBytes, nil
+	return file, localFname, numBytes, stored, encoding, obj.Meta, digests.Checksum(), nil
 }
 
-func s3Upload(bucketName string, fkey string, localFname string, numBytes int64) *AppError {
-	//read file from disk and upload to S3
-	file, errF := os.Open(localFname)
-	if errF != nil {
-		return &AppError{errF, "Could not open local File", 500}
+//cacheFromS3 downloads an object into the local cache.  The returned content is positioned
+//at the start
+func cacheFromS3(bucketName string, dirPath string, fname string, args *loadArgs.Args) (*queues.Decoder, *queues.Metadata, *AppError) {
+	file, localFname, numBytes, stored, encoding, meta, checksum, errD := s3Download(bucketName, dirPath, fname, args)
+	if errD != nil {
+		return nil, nil, errD
+	}
+	content, errR := lru.Unseal(file)
+	if errR != nil {
+		file.Close()
+		lru.Discard(bucketName, dirPath+fname, localFname)
+		return nil, nil, internalError(errR, "Could not decrypt local File")
+	}
+	//if small enough then add to memory and disk.  Compressed objects are kept compressed,
+	//encrypted ones are decrypted
+	var errQ error
+	if stored < args.MaxMemSize() {
+		d, errR := ioutil.ReadAll(content)
+		if errR == nil {
+			_, errR = content.Seek(0, io.SeekStart)
+		}
+		if errR != nil {
+			file.Close()
+			lru.Discard(bucketName, dirPath+fname, localFname)
+			return nil, nil, internalError(errR, "Could read from file")
+		}
+		_, errQ = lru.Add(bucketName, dirPath+fname, localFname, stored, true, d, meta, checksum, encoding, numBytes)
+	} else { //Otherwise just add to disk
+		_, errQ = lru.Add(bucketName, dirPath+fname, localFname, stored, false, nil, meta, checksum, encoding, numBytes)
 	}
-	defer file.Close()
+	if errQ != nil {
+		//still serve the download, the open handle outlives the file
+		log.Warnln("Not caching", bucketName, dirPath+fname, errQ)
+		lru.Discard(bucketName, dirPath+fname, localFname)
+	}
+	return queues.Decode(content, encoding, numBytes), meta, nil
+}
 
-	buffer := make([]byte, numBytes)
-	file.Read(buffer)
-	fileBytes := bytes.NewReader(buffer)
+//s3Head fetches only the object headers from S3, for HEAD requests on uncached objects
+func s3Head(bucketName string, fkey string) (*queues.Metadata, int64, *AppError) {
+	obj, err := store.Head(bucketName, fkey)
+	if err != nil {
+		return nil, 0, upstreamError(err, "Could not Head object in S3")
+	}
+	return obj.Meta, obj.TotalSize, nil
+}
 
-	params := &s3.PutObjectInput{
-		Bucket: aws.String(bucketName), // required
-		Key:    aws.String(fkey),       // required
-		Body:   fileBytes,
-		Metadata: map[string]*string{
-			"Key": aws.String(""), //required
-		},
+func s3Upload(bucketName string, fkey string, localFname string, numBytes int64, encoding string, meta *queues.Metadata) *AppError {
+	//read file from disk and upload to S3, as it was before the cache compressed or encrypted it
+	file, errF := os.Open(localFname)
+	if errF != nil {
+		return internalError(errF, "Could not open local File")
 	}
-	svc := s3.New(session.New(&aws.Config{Region: aws.String("us-west-1")}))
-	_, errU := svc.PutObject(params)
+	stored, errF := lru.Unseal(file)
+	if errF != nil {
+		file.Close()
+		return internalError(errF, "Could not decrypt local File")
+	}
+	content := queues.Decode(stored, encoding, numBytes)
+	defer content.Close()
+
+	obj, errU := store.Put(bucketName, fkey, content, numBytes, meta)
 	if errU != nil {
-		return &AppError{errU, "Could not Upload to S3", 500}
+		return upstreamError(errU, "Could not Upload to S3")
+	}
+	//an SSE-KMS or SSE-C ETag never matches, S3 checked the Content-MD5 sent with the upload
+	if etag := obj.Meta.ETag; obj.ETagIsMD5() == true && etag != "" && etag != meta.ETag && contentMD5(etag) != "" {
+		log.Errorln("S3 ETag does not match uploaded content", bucketName, fkey, etag, meta.ETag)
+		return internalError(fmt.Errorf("ETag mismatch %s != %s", etag, meta.ETag), "Uploaded object does not match its ETag")
 	}
 	log.Infoln("file uploaded to s3")
 	return nil
 }
 
+//serveObject writes a cached object with its stored metadata.  ServeContent takes
+//care of HEAD, Range and conditional requests.  An object the cache compressed goes out as
+//stored to clients accepting its encoding, unless they asked for a range of it
+func serveObject(w http.ResponseWriter, r *http.Request, fkey string, meta *queues.Metadata, encoding string, content *queues.Decoder) {
+	meta.WriteHeader(w.Header())
+	var modTime time.Time
+	if meta != nil {
+		modTime = meta.LastModified
+	}
+	if encoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Header.Get("Range") == "" && acceptsEncoding(r.Header.Get("Accept-Encoding"), encoding) == true {
+			w.Header().Set("Content-Encoding", encoding)
+			http.ServeContent(w, r, fkey, modTime, content.Stored())
+			return
+		}
+	}
+	http.ServeContent(w, r, fkey, modTime, content)
+}
+
+//acceptsEncoding is true if an Accept-Encoding header allows encoding
+func acceptsEncoding(accept string, encoding string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.TrimSpace(fields[0])
+		if strings.EqualFold(name, encoding) == false && name != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if q := strings.Replace(strings.TrimSpace(param), " ", "", -1); strings.HasPrefix(q, "q=") {
+				if weight, err := strconv.ParseFloat(q[2:], 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
 func s3Get(w http.ResponseWriter, r *http.Request, fname string, bucketName string, dirPath string, args *loadArgs.Args) *AppError {
-	mutex.Lock()
 	node, avail := lru.Retrieve(dirPath+fname, bucketName)
-	mutex.Unlock()
+	var content *queues.Decoder
+	if avail == true {
+		var errO error
+		content, errO = lru.Open(node)
+		if os.IsNotExist(errO) {
+			//evicted or replaced since Retrieve, that's a miss
+			log.Debugln("Cached file went away, treating it as a miss", bucketName, dirPath+fname)
+			avail = false
+		} else if errO != nil {
+			return internalError(errO, "Could not open local File")
+		}
+	}
 
 	if avail == false {
 		log.Debugln("File not in local FS")
@@ -117,44 +257,57 @@ func s3Get(w http.ResponseWriter, r *http.Request, fname string, bucketName stri
 			check, res = CheckFileInPeerNode(dirPath+fname, bucketName, args)
 		}
 
-		if check == false {
+		if check == false && r.Method == "HEAD" {
+			log.Debugln("File not in local FS or Global Hash, HEAD from S3")
+			meta, size, errH := s3Head(bucketName, dirPath+fname)
+			if errH != nil {
+				return errH
+			}
+			meta.WriteHeader(w.Header())
+			w.Header().Set("Last-Modified", meta.LastModified.UTC().Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.WriteHeader(http.StatusOK)
+		} else if offset, length, ok := parseRange(r.Header.Get("Range")); check == false && ok {
+			//serve just the range from upstream and cache the whole object in the background
+			log.Debugln("File not in local FS or Global Hash, ranged GET from S3")
+			setSource(w, metrics.SourceS3)
+			size, errR := s3GetRange(w, bucketName, dirPath+fname, offset, length)
+			if errR != nil {
+				return errR
+			}
+			go fillFromRange(bucketName, dirPath, fname, size, args)
+		} else if check == false {
 			log.Debugln("File not in local FS or Global Hash, download from S3")
-			file, numBytes, errD := s3Download(bucketName, dirPath, fname, args)
-			defer file.Close()
-			if errD != nil {
+			content, meta, errD := cacheFromS3(bucketName, dirPath, fname, args)
+			if errD != nil && diskFull(errD.Error) == true {
+				//no room to cache it, pass it through instead.  A SlowDown from S3 itself isn't retried
+				setSource(w, metrics.SourceS3)
+				return s3Stream(w, bucketName, dirPath+fname)
+			} else if errD != nil {
 				return errD
 			}
-			//if small enough then add to memory and disk.
-			if numBytes < args.MaxMemFileSize {
-				d, errR := ioutil.ReadAll(file)
-				if errR != nil {
-					return &AppError{errR, "Could read from file", 500}
-				}
-				mutex.Lock()
-				lru.Add(bucketName, dirPath+fname, numBytes, true, d)
-				mutex.Unlock()
-			} else { //Otherwise just add to disk
-				mutex.Lock()
-				lru.Add(bucketName, dirPath+fname, numBytes, false, nil)
-				mutex.Unlock()
-			}
-			http.ServeFile(w, r, args.LocalPath+bucketName+"/"+dirPath+fname)
+			defer content.Close()
+			setSource(w, metrics.SourceS3)
+			//served decompressed, like anything passed through from the backend
+			serveObject(w, r, dirPath+fname, meta, "", content)
 		} else { //if in Global Hash then redirt to that host
 			log.Debugln("File in Global Hash, Redirect client to Peer", res)
 			//NOT cool, need to fix this
 			newAddr := strings.Split(res, ":")[0]
+			setSource(w, metrics.SourcePeer)
 			http.Redirect(w, r, "http://"+newAddr+":"+args.ClientPort+"/"+bucketName+"/"+dirPath+fname, 307)
 		}
 
 	} else {
 		log.Debugln("File IS in local FS")
+		defer content.Close()
 		if node.Inmem == true {
-			mutex.RLock()
-			http.ServeContent(w, r, node.Fkey, node.ModTime, node.MemFile)
-			mutex.RUnlock()
+			setSource(w, metrics.SourceMem)
 		} else {
-			http.ServeFile(w, r, args.LocalPath+bucketName+"/"+dirPath+fname)
+			setSource(w, metrics.SourceDisk)
 		}
+		serveObject(w, r, node.Fkey, node.Meta, node.Encoding, content)
 	}
 	log.Debugln("Request for ", dirPath+fname, bucketName)
 	return nil
@@ -162,25 +315,170 @@ func s3Get(w http.ResponseWriter, r *http.Request, fname string, bucketName stri
 
 func s3GetHandler(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) *AppError {
 	//get inputs from url and send to s3Get to download from S3.
+	identity, errA := authenticate(r)
+	if errA != nil {
+		writeError(w, r, errA)
+		return nil
+	}
 	vars := mux.Vars(r)
 	fname := vars["fname"]
 	bucket := vars["bucket"]
 	splits := strings.SplitN(bucket, "/", 2)
 	bucketName := splits[0]
 	dirPath := splits[1]
+	if errB := checkBucketName(bucketName); errB != nil {
+		writeError(w, r, errB)
+		return nil
+	}
+	//a GET on the bucket itself lists its objects
+	if dirPath+fname == "" {
+		if errP := authorize(r, identity, bucketName, r.URL.Query().Get("prefix"), false); errP != nil {
+			writeError(w, r, errP)
+			return nil
+		}
+		if errL := s3List(w, r, bucketName); errL != nil {
+			writeError(w, r, errL)
+		}
+		return nil
+	}
+	if errP := authorize(r, identity, bucketName, dirPath+fname, false); errP != nil {
+		writeError(w, r, errP)
+		return nil
+	}
 	err := s3Get(w, r, fname, bucketName, dirPath, args)
 	if err != nil {
-		http.Error(w, err.Message, 500)
+		writeError(w, r, err)
 	}
 	return nil
 }
 
-func uploader(bucketName string, fkey string, localFname string, numBytes int64) *AppError {
-	//id int, results chan<- int
-	err := s3Upload(bucketName, fkey, localFname, numBytes)
+//parseRange handles the single range forms "bytes=first-last" and "bytes=first-".  Other
+//forms are left to http.ServeContent once the whole object is cached
+func parseRange(header string) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, 0, false
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+	if bounds[1] == "" {
+		return first, -1, true
+	}
+	last, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+	return first, last - first + 1, true
+}
+
+//s3Stream passes a whole object straight from the backend to the client without caching it
+func s3Stream(w http.ResponseWriter, bucketName string, fkey string) *AppError {
+	obj, err := store.Get(bucketName, fkey)
 	if err != nil {
-		log.Errorln("S3 upload Error:", err)
+		return upstreamError(err, "Could not Dowload from S3")
 	}
+	defer obj.Body.Close()
+	obj.Meta.WriteHeader(w.Header())
+	w.Header().Set("Last-Modified", obj.Meta.LastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, obj.Body)
+	return nil
+}
+
+//s3GetRange streams part of an uncached object straight from the backend and returns the
+//size of the whole object
+func s3GetRange(w http.ResponseWriter, bucketName string, fkey string, offset int64, length int64) (int64, *AppError) {
+	obj, err := store.GetRange(bucketName, fkey, offset, length)
+	if err != nil {
+		return 0, upstreamError(err, "Could not Dowload from S3")
+	}
+	defer obj.Body.Close()
+	obj.Meta.WriteHeader(w.Header())
+	w.Header().Set("Last-Modified", obj.Meta.LastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+obj.Size-1, obj.TotalSize))
+	w.WriteHeader(http.StatusPartialContent)
+	io.Copy(w, obj.Body)
+	return obj.TotalSize, nil
+}
+
+//fills are the objects being cached in the background after a ranged GET, by bucket/key
+var fills = struct {
+	sync.Mutex
+	inFlight map[string]bool
+}{inFlight: make(map[string]bool)}
+
+//fillFromRange caches the whole of an object a ranged GET missed.  Parallel ranged readers
+//of the same object, as the aws cli and transfer managers are, only download it once, and an
+//object too big for the cache isn't downloaded at all
+func fillFromRange(bucketName string, dirPath string, fname string, size int64, args *loadArgs.Args) {
+	if lru.Fits(size) == false {
+		log.Debugln("Not caching", bucketName, dirPath+fname, "it doesn't fit")
+		return
+	}
+	key := bucketName + "/" + dirPath + fname
+	fills.Lock()
+	if fills.inFlight[key] == true {
+		fills.Unlock()
+		return
+	}
+	fills.inFlight[key] = true
+	fills.Unlock()
+	defer func() {
+		fills.Lock()
+		delete(fills.inFlight, key)
+		fills.Unlock()
+	}()
+	//a reader that started before the last fill finished may find it cached now
+	if lru.Peek(dirPath+fname, bucketName) != nil {
+		return
+	}
+	content, _, errD := cacheFromS3(bucketName, dirPath, fname, args)
+	if errD != nil {
+		log.Errorln("Could not cache object", bucketName, dirPath+fname, errD.Message)
+		return
+	}
+	content.Close()
+}
+
+//uploadAttempts before a background upload is given up on
+const uploadAttempts = 4
+
+func uploader(up *pendingUpload) *AppError {
+	//id int, results chan<- int
+	metrics.UploadBacklog.Inc()
+	defer metrics.UploadBacklog.Dec()
+	defer uploads.done(up)
+	if up.discard == true {
+		defer lru.Discard(up.Bucket, up.Key, up.localFname)
+	}
+	bucketName, fkey, localFname, numBytes, encoding, meta := up.Bucket, up.Key, up.localFname, up.Size, up.encoding, up.meta
+
+	var err *AppError
+	backoff := time.Second
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		err = s3Upload(bucketName, fkey, localFname, numBytes, encoding, meta)
+		uploads.attempt(up, err)
+		if err == nil {
+			return nil
+		}
+		log.Errorln("S3 upload Error:", attempt, err.Message, err.Error)
+		//client errors won't go away on a retry
+		if err.Code >= 400 && err.Code < 500 || attempt == uploadAttempts {
+			break
+		}
+		metrics.UploadRetries.Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	metrics.UploadFailures.Inc()
 	//results <- 1
 	return err
 }
@@ -188,48 +486,81 @@ func uploader(bucketName string, fkey string, localFname string, numBytes int64)
 func s3Put(w http.ResponseWriter, r *http.Request, fname string, bucketName string, dirPath string, args *loadArgs.Args) *AppError {
 	//key is the filename and full path.  Create a local file
 
-	localPath := args.LocalPath + bucketName + "/" + dirPath
-	errD := os.MkdirAll(localPath, 0755)
-	if errD != nil {
-		return &AppError{errD, "Could not create local Directories", 500}
+	localFname, errP := lru.Place(bucketName, dirPath+fname, r.ContentLength)
+	if diskFull(errP) == true {
+		return noSpaceError(errP)
+	} else if errP != nil {
+		return internalError(errP, "Could not place local File")
 	}
-	file, errF := os.Create(localPath + fname)
+	//written under a temp name and renamed into place once verified, so GETs never see part of it.
+	//It's compressed and encrypted on the way, as the settings say
+	meta := queues.MetadataFromHeader(r.Header)
+	cw, errF := lru.NewWriter(localFname, lru.Encoding(meta))
 	if errF != nil {
-		return &AppError{errF, "Could not create local File", 500}
+		return internalError(errF, "Could not create local File")
 	}
 
-	numBytes, errC := io.Copy(file, r.Body)
+	digests := newDigester(r.Header)
+	numBytes, errC := io.Copy(io.MultiWriter(cw, digests), r.Body)
 	if errC != nil {
-		return &AppError{errC, "Could not Copy to local File", 500}
+		cw.Abort()
+		if diskFull(errC) == true {
+			return noSpaceError(errC)
+		}
+		return internalError(errC, "Could not Copy to local File")
+	}
+	if errV := digests.verify(r.Header); errV != nil {
+		cw.Abort()
+		return errV
+	}
+	meta.ETag = digests.ETag()
+	file, encoding, stored, errC := cw.Finish()
+	if errC == nil {
+		//until it's uploaded the cache file is the only copy, so it's synced unless Fsync is never
+		localFname, errC = lru.Store(file, bucketName, dirPath+fname, localFname, digests.Checksum(), encoding, args.Fsync != "never")
+		file.Close()
+		if errC != nil {
+			os.Remove(file.Name())
+		}
+	}
+	if errC != nil {
+		if diskFull(errC) == true {
+			return noSpaceError(errC)
+		}
+		return internalError(errC, "Could not write local File")
 	}
-	file.Close()
 
-	//new thread for background S3 upload
-	//results := make(chan int, 1)
-	//go uploader(bucketName, dirPath+fname, localPath+fname, numBytes, 1, results)
-	go uploader(bucketName, dirPath+fname, localPath+fname, numBytes)
+	w.Header().Set("ETag", meta.ETag)
 
 	//log.Debugln(args.Cluster)
-	if args.Cluster == true {
+	if args.Cluster == true && lru.Draining() == false {
 		log.Debugln("Add to GH", dirPath+fname, bucketName, args.LocalName)
 		go hashes.Ghash.AddToGH(dirPath+fname, bucketName, args.LocalName, true)
 	}
 
-	//add to local file queue
-	if numBytes < args.MaxMemFileSize { //if small enough then add to memory too
-		d, err := ioutil.ReadAll(r.Body)
-		defer r.Body.Close()
-		if err != nil {
-			return &AppError{errC, "Could not Read from local File", 500}
+	//add to local file queue.  The file is uploaded either way, one that isn't queued is
+	//given back once the upload is done with it
+	up := uploads.start(bucketName, dirPath+fname, localFname, numBytes, encoding, digests.Checksum(), meta)
+	var errQ error
+	if stored < args.MaxMemSize() { //if small enough then add to memory too, compressed if it is
+		d, err := lru.ReadStored(localFname)
+		if err == nil {
+			_, errQ = lru.Add(bucketName, dirPath+fname, localFname, stored, true, d, meta, digests.Checksum(), encoding, numBytes)
+		} else {
+			errQ = err
 		}
-		mutex.Lock()
-		lru.Add(bucketName, dirPath+fname, numBytes, true, d)
-		mutex.Unlock()
 	} else {
-		mutex.Lock()
-		lru.Add(bucketName, dirPath+fname, numBytes, false, nil)
-		mutex.Unlock()
+		_, errQ = lru.Add(bucketName, dirPath+fname, localFname, stored, false, nil, meta, digests.Checksum(), encoding, numBytes)
+	}
+	if errQ != nil {
+		log.Warnln("Not caching", bucketName, dirPath+fname, errQ)
+		up.discard = true
 	}
+	//new thread for background S3 upload
+	//results := make(chan int, 1)
+	//go uploader(bucketName, dirPath+fname, localFname, numBytes, 1, results)
+	go uploader(up)
+
 	//wait for s3 upload to finish
 	//<-results
 	log.Infoln("File uploaded successfully")
@@ -239,43 +570,213 @@ func s3Put(w http.ResponseWriter, r *http.Request, fname string, bucketName stri
 func s3PutHandler(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) *AppError {
 	//get inputs from url and send to s3Put to upload to S3.  All PUT requests get written
 	//to S3 and local even if they already exists
+	identity, errA := authenticate(r)
+	if errA != nil {
+		writeError(w, r, errA)
+		return nil
+	}
 	vars := mux.Vars(r)
 	fname := vars["fname"]
 	bucket := vars["bucket"]
 	splits := strings.SplitN(bucket, "/", 2)
 	bucketName := splits[0]
 	dirPath := splits[1]
+	if errB := checkBucketName(bucketName); errB != nil {
+		writeError(w, r, errB)
+		return nil
+	}
+	if errP := authorize(r, identity, bucketName, dirPath+fname, true); errP != nil {
+		writeError(w, r, errP)
+		return nil
+	}
+	if auth.Streaming(r.Header) == true {
+		//checked by Verify too, but without access keys nothing else would catch it
+		writeError(w, r, &AppError{Message: auth.ErrStreaming.Message, Code: auth.ErrStreaming.Status, S3Code: auth.ErrStreaming.Code})
+		return nil
+	}
 	err := s3Put(w, r, fname, bucketName, dirPath, args)
 	if err != nil {
-		log.Errorln("Error in PUT", args.LocalPath+bucketName+"/"+dirPath+fname, err)
-		http.Error(w, err.Message, 500)
+		log.Errorln("Error in PUT", bucketName, dirPath+fname, err.Message)
+		writeError(w, r, err)
+		return nil
 	}
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "File Uploading")
 	return nil
 }
 
+func s3DeleteHandler(w http.ResponseWriter, r *http.Request, args *loadArgs.Args) *AppError {
+	//delete upstream first, then drop the local copy
+	identity, errA := authenticate(r)
+	if errA != nil {
+		writeError(w, r, errA)
+		return nil
+	}
+	vars := mux.Vars(r)
+	splits := strings.SplitN(vars["bucket"], "/", 2)
+	bucketName := splits[0]
+	fkey := splits[1] + vars["fname"]
+	if errB := checkBucketName(bucketName); errB != nil {
+		writeError(w, r, errB)
+		return nil
+	}
+	if errP := authorize(r, identity, bucketName, fkey, true); errP != nil {
+		writeError(w, r, errP)
+		return nil
+	}
+	if err := store.Delete(bucketName, fkey); err != nil {
+		writeError(w, r, upstreamError(err, "Could not Delete from S3"))
+		return nil
+	}
+	lru.Remove(fkey, bucketName)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+//settingFlags collects -set Name=Value config overrides
+type settingFlags map[string]string
+
+func (s settingFlags) String() string {
+	return fmt.Sprint(map[string]string(s))
+}
+
+func (s settingFlags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expecting Name=Value, got %q", value)
+	}
+	s[kv[0]] = kv[1]
+	return nil
+}
+
+//clientRouter routes the S3 requests clients send, and the health endpoints.  The handler
+//functions get the args struct passed in
+func clientRouter(args *loadArgs.Args) *mux.Router {
+	router := mux.NewRouter() //.StrictSlash(true)
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
+	router.HandleFunc("/healthz", healthz).Methods("GET", "HEAD")
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyz(w, r, args)
+	}).Methods("GET", "HEAD")
+	router.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		statusHandler(w, r, args)
+	}).Methods("GET")
+	router.HandleFunc("/{bucket:[a-zA-Z0-9-\\.\\/]*\\/}{fname:[a-zA-Z0-9-_\\.]*$}", instrumented(func(w http.ResponseWriter, r *http.Request) {
+		s3PutHandler(w, r, args)
+	})).Methods("PUT", "POST")
+	router.HandleFunc("/{bucket:[a-zA-Z0-9-\\.\\/]*[\\/]+}{fname:[a-zA-Z0-9-_\\.]*$}", instrumented(func(w http.ResponseWriter, r *http.Request) {
+		//router.HandleFunc("/{bucket:[a-zA-Z0-9-\\.\\/]*[\\/]+}{fname:[.]*$}", func(w http.ResponseWriter, r *http.Request) {
+		s3GetHandler(w, r, args)
+	})).Methods("GET", "HEAD")
+	router.HandleFunc("/{bucket:[a-zA-Z0-9-\\.\\/]*[\\/]+}{fname:[a-zA-Z0-9-_\\.]*$}", instrumented(func(w http.ResponseWriter, r *http.Request) {
+		s3DeleteHandler(w, r, args)
+	})).Methods("DELETE")
+	return router
+}
+
+//headerTimeout and idleTimeout drop connections that are slow to send a request or left idle.
+//Bodies have no deadline, an object may take any time to stream
+const (
+	headerTimeout = 10 * time.Second
+	idleTimeout   = 2 * time.Minute
+)
+
 func main() {
 	runtime.GOMAXPROCS(2)
 
 	log.SetLevel(log.DebugLevel)
 
-	var conf = flag.String("config", "/Users/bparli/go/bin/config.json", "location of config.json")
-	var port = flag.String("port", "8081", "server port number")
+	var conf = flag.String("config", "/Users/bparli/go/bin/config.json", "location of the config file, JSON, YAML (.yaml, .yml) or TOML (.toml)")
+	var port = flag.String("port", "", "server port number, overrides ClientPort")
+	settings := settingFlags{}
+	flag.Var(settings, "set", "override a config setting, e.g. -set MemCap=2G (repeatable)")
+	var printConfig = flag.Bool("print-config", false, "print the effective config and exit")
+	var printSchema = flag.Bool("print-schema", false, "print the JSON Schema of the config file and exit")
 	flag.Parse()
+	if *port != "" {
+		settings["ClientPort"] = *port
+	}
+
+	if *printSchema == true || *printConfig == true {
+		var out []byte
+		var err error
+		if *printSchema == true {
+			out, err = loadArgs.Schema()
+		} else {
+			out, err = loadArgs.Effective(*conf, settings)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(string(out))
+		return
+	}
 
-	//load arguments from config.json
-	args := loadArgs.Load(*conf)
+	//load arguments from config.json, the environment and the command line
+	args, errL := loadArgs.Load(*conf, settings)
+	if errL != nil {
+		log.Fatalln(errL)
+	}
+	level, _ := log.ParseLevel(args.LogLevel)
+	log.SetLevel(level)
 
 	//initialize the local LRU queue
 	lru = queues.InitializeQueue(args)
 
+	//upstream object store, S3 unless configured otherwise
+	var errB error
+	store, errB = backend.New(args)
+	if errB != nil {
+		log.Fatalln("Could not create backend:", errB)
+	}
+	store = timedBackend{store}
+
+	//client requests must be SigV4 signed with one of the configured access keys
+	if len(args.AccessKeys) > 0 {
+		verifier = auth.NewVerifier(args.AccessKeys)
+	}
+
+	//only the buckets and prefixes in the policy are proxied
+	if len(args.Buckets) > 0 {
+		var errP error
+		bucketPolicy, errP = policy.New(args.Buckets)
+		if errP != nil {
+			log.Fatalln("Invalid bucket policy:", errP)
+		}
+	}
+
 	//based on arguments, if clustered then initialize the global hash table
 	if args.Cluster == true {
 		hashes.InitGH(args)
+		hashes.OnPurge = func(bucket string, fkey string, prefix bool) {
+			purged := purgeLocal(bucket, fkey, prefix)
+			log.Infoln("Peer purge", bucket, fkey, "prefix:", prefix, "purged:", len(purged))
+		}
 		go hashes.HashMan(args.HashPort)
 	}
 
+	//what was cached before the restart, announced to the cluster like new objects
+	lru.Restore()
+	//restart the uploads the last shutdown didn't get to finish
+	uploads.resume(args.LocalPath + uploadsFile)
+	//writes a crash interrupted never made it into the queue, and blobs nothing claimed
+	lru.CleanTemp()
+
+	//operator API for inspecting and purging the cache
+	admin := adminServer(args)
+
+	//background verification of cached content
+	go scrubber(args)
+
+	//a failed disk takes only its own cache directory out of use
+	go dirChecker(args)
+
+	//evict before the disks fill, whatever filled them
+	go spaceChecker(args)
+
+	//retention rules with a MaxAge
+	go expirer()
+
 	var err error
 	memberlistConfig := memberlist.DefaultLocalConfig()
 	localIP := strings.Split(args.LocalName, ":")[0]
@@ -297,15 +798,24 @@ func main() {
 		log.Errorln("Failed to join cluster: " + err.Error())
 	}
 
-	//use mux router and handler functions with the args struct being passed in
-	router := mux.NewRouter() //.StrictSlash(true)
-	router.HandleFunc("/{bucket:[a-zA-Z0-9-\\.\\/]*\\/}{fname:[a-zA-Z0-9-_\\.]*$}", func(w http.ResponseWriter, r *http.Request) {
-		s3PutHandler(w, r, args)
-	}).Methods("PUT", "POST")
-	router.HandleFunc("/{bucket:[a-zA-Z0-9-\\.\\/]*[\\/]+}{fname:[a-zA-Z0-9-_\\.]*$}", func(w http.ResponseWriter, r *http.Request) {
-		//router.HandleFunc("/{bucket:[a-zA-Z0-9-\\.\\/]*[\\/]+}{fname:[.]*$}", func(w http.ResponseWriter, r *http.Request) {
-		s3GetHandler(w, r, args)
-	}).Methods("GET")
-
-	http.ListenAndServe(":"+*port, router)
+	server := &http.Server{Addr: ":" + args.ClientPort, Handler: clientRouter(args), ReadHeaderTimeout: headerTimeout,
+		IdleTimeout: idleTimeout}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+
+	//pick up config changes on SIGHUP, or when the file changes if ConfigWatch is set
+	go watchConfig(*conf, args)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			reload(*conf, args)
+			continue
+		}
+		break
+	}
+	shutdown(server, admin, args)
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"s3envoy/hashes"
+	"s3envoy/loadArgs"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//leaveTimeout bounds how long memberlist gets to tell the cluster we're going
+const leaveTimeout = 5 * time.Second
+
+//shutdown takes the node out of service on SIGTERM/SIGINT.  Peers are told to stop
+//redirecting here, in-flight requests on server and the admin one, which may be nil, and
+//uploads get until ShutdownTimeout to finish and any uploads left over are persisted to be
+//resumed on the next start
+func shutdown(server *http.Server, admin *http.Server, args *loadArgs.Args) {
+	deadline := time.Now().Add(args.ShutdownTimeout)
+	log.Infoln("Shutting down, waiting up to", args.ShutdownTimeout, "for requests and uploads")
+
+	if args.Cluster == true {
+		lru.Drain()
+		hashes.Ghash.Leave()
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorln("Requests still in flight at the shutdown deadline:", err)
+	}
+	if admin != nil {
+		if err := admin.Shutdown(ctx); err != nil {
+			log.Errorln("Admin requests still in flight at the shutdown deadline:", err)
+		}
+	}
+
+	if uploads.wait(deadline) == false {
+		path := args.LocalPath + uploadsFile
+		if err := uploads.persist(path); err != nil {
+			log.Errorln("Could not persist pending uploads, they will be lost:", err)
+		} else {
+			log.Warnln("Uploads still pending at the shutdown deadline, saved to", path)
+		}
+	}
+
+	if args.Members != nil {
+		if err := args.Members.Leave(leaveTimeout); err != nil {
+			log.Errorln("Failed to leave cluster:", err)
+		}
+		args.Members.Shutdown()
+	}
+	log.Infoln("Shutdown complete")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"s3envoy/metrics"
+	"s3envoy/queues"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+//pendingUpload is a background upload to the backend that hasn't finished yet
+type pendingUpload struct {
+	Bucket     string
+	Key        string
+	Size       int64
+	Started    time.Time
+	Attempts   int
+	LastError  string
+	localFname string
+	encoding   string //compression of the cache file, see queues.Writer
+	checksum   string
+	meta       *queues.Metadata
+	discard    bool //the file couldn't be queued, so it's Discarded after the upload
+}
+
+//savedUpload is a pending upload persisted across a restart
+type savedUpload struct {
+	Bucket     string
+	Key        string
+	LocalFname string
+	Size       int64
+	Encoding   string `json:",omitempty"`
+	Checksum   string `json:",omitempty"`
+	Meta       *queues.Metadata
+}
+
+//uploadsFile under LocalPath holds the uploads that didn't finish before shutdown
+const uploadsFile = ".uploads.json"
+
+//uploadTracker keeps the uploads in flight so operators can see the backlog
+type uploadTracker struct {
+	pending map[*pendingUpload]bool
+	mutex   sync.Mutex
+}
+
+var uploads = &uploadTracker{pending: make(map[*pendingUpload]bool)}
+
+//start tracks an upload before its goroutine runs, so shutdown can't miss it
+func (t *uploadTracker) start(bucket string, fkey string, localFname string, size int64, encoding string, checksum string, meta *queues.Metadata) *pendingUpload {
+	up := &pendingUpload{Bucket: bucket, Key: fkey, Size: size, Started: time.Now(),
+		localFname: localFname, encoding: encoding, checksum: checksum, meta: meta}
+	t.mutex.Lock()
+	t.pending[up] = true
+	t.mutex.Unlock()
+	return up
+}
+
+//attempt records a try at the upload and the error it failed with, if any
+func (t *uploadTracker) attempt(up *pendingUpload, err *AppError) {
+	t.mutex.Lock()
+	up.Attempts++
+	if err != nil {
+		up.LastError = err.Message
+	}
+	t.mutex.Unlock()
+}
+
+//pendingFor is true while an object has an upload in flight
+func (t *uploadTracker) pendingFor(bucket string, fkey string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for up := range t.pending {
+		if up.Bucket == bucket && up.Key == fkey {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *uploadTracker) done(up *pendingUpload) {
+	t.mutex.Lock()
+	delete(t.pending, up)
+	t.mutex.Unlock()
+}
+
+//list returns a copy of the pending uploads, oldest first
+func (t *uploadTracker) list() []pendingUpload {
+	t.mutex.Lock()
+	list := make([]pendingUpload, 0, len(t.pending))
+	for up := range t.pending {
+		list = append(list, *up)
+	}
+	t.mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+//wait for the pending uploads to finish, giving up at the deadline.  Returns true if none are left
+func (t *uploadTracker) wait(deadline time.Time) bool {
+	for {
+		t.mutex.Lock()
+		left := len(t.pending)
+		t.mutex.Unlock()
+		if left == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//persist writes the uploads still pending to path so they can be resumed on the next start
+func (t *uploadTracker) persist(path string) error {
+	t.mutex.Lock()
+	saved := make([]savedUpload, 0, len(t.pending))
+	for up := range t.pending {
+		saved = append(saved, savedUpload{Bucket: up.Bucket, Key: up.Key, LocalFname: up.localFname,
+			Size: up.Size, Encoding: up.encoding, Checksum: up.checksum, Meta: up.meta})
+	}
+	t.mutex.Unlock()
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+//resume restarts the uploads persisted at path by the last shutdown.  It runs after
+//lru.Restore, and queues the files Restore didn't
+func (t *uploadTracker) resume(path string) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Errorln("Could not read pending uploads", err)
+		return
+	}
+	var saved []savedUpload
+	if err = json.Unmarshal(data, &saved); err != nil {
+		log.Errorln("Could not parse pending uploads", path, err)
+		return
+	}
+	for _, su := range saved {
+		if _, errS := os.Stat(su.LocalFname); errS != nil {
+			log.Errorln("Lost pending upload", su.Bucket, su.Key, errS)
+			metrics.UploadFailures.Inc()
+			continue
+		}
+		if su.Meta == nil {
+			su.Meta = &queues.Metadata{}
+		}
+		log.Infoln("Resuming upload", su.Bucket, su.Key)
+		up := t.start(su.Bucket, su.Key, su.LocalFname, su.Size, su.Encoding, su.Checksum, su.Meta)
+		if errQ := lru.Requeue(su.Bucket, su.Key, su.LocalFname, su.Meta, su.Checksum, su.Encoding, su.Size); errQ != nil {
+			log.Warnln("Not caching", su.Bucket, su.Key, errQ)
+			up.discard = true
+		}
+		go uploader(up)
+	}
+	os.Remove(path)
+}